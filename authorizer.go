@@ -0,0 +1,268 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authorizerMaxCacheSize is the number of decisions cached before expired entries are purged
+var authorizerMaxCacheSize = 10000
+
+// authorizerInput is the input document sent to the policy endpoint
+type authorizerInput struct {
+	// Method is the method of the request
+	Method string `json:"method"`
+	// Path is the path of the request
+	Path string `json:"path"`
+	// Headers are the headers of the request
+	Headers map[string]string `json:"headers"`
+	// User is the identity of the user
+	User authorizerUser `json:"user"`
+	// Claims are the claims of the access token
+	Claims jose.Claims `json:"claims"`
+	// Resource is the resource protecting the request
+	Resource *Resource `json:"resource"`
+}
+
+// authorizerUser is the identity of the user in the input document
+type authorizerUser struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	Groups   []string `json:"groups"`
+}
+
+// authorizerDecision is the decision of the policy endpoint
+type authorizerDecision struct {
+	// Allow indicates the request is permitted
+	Allow bool `json:"allow"`
+	// Headers are injected into the upstream request when permitted
+	Headers map[string]string `json:"headers"`
+}
+
+// cachedDecision is a decision held in the cache
+type cachedDecision struct {
+	decision authorizerDecision
+	expires  time.Time
+}
+
+// externalAuthorizer delegates the authorization of requests to a policy endpoint, i.e. open policy
+// agent; the input document is posted as {"input": ...} and the result is either a boolean or an
+// object holding allow and the headers to inject
+type externalAuthorizer struct {
+	sync.RWMutex
+	// the url of the policy endpoint
+	endpoint string
+	// the http client for the policy endpoint
+	client *http.Client
+	// the elements making up the cache key
+	cacheKey []string
+	// the duration decisions are cached for
+	cacheTTL time.Duration
+	// the cached decisions
+	cache map[string]cachedDecision
+	// the errors from the policy endpoint
+	errors prometheus.Counter
+}
+
+// newExternalAuthorizer creates an authorizer from the configuration
+func newExternalAuthorizer(config *Config) *externalAuthorizer {
+	errorMetric := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_authorizer_errors_total",
+		Help: "The number of errors from the external authorizer, the requests are denied",
+	})
+	if collector, err := prometheus.RegisterOrGet(errorMetric); err == nil {
+		errorMetric = collector.(prometheus.Counter)
+	}
+
+	return &externalAuthorizer{
+		endpoint: config.AuthorizerURL,
+		client:   &http.Client{Timeout: config.AuthorizerTimeout},
+		cacheKey: config.AuthorizerCacheKey,
+		cacheTTL: config.AuthorizerCacheTTL,
+		cache:    make(map[string]cachedDecision),
+		errors:   errorMetric,
+	}
+}
+
+// authorize returns the decision for the request, an error is a deny
+func (a *externalAuthorizer) authorize(req *http.Request, user *userContext, resource *Resource) (authorizerDecision, error) {
+	key := a.getCacheKey(req, user, resource)
+	if decision, found := a.getCachedDecision(key); found {
+		return decision, nil
+	}
+	decision, err := a.query(req, user, resource)
+	if err != nil {
+		a.errors.Inc()
+		return authorizerDecision{}, err
+	}
+	a.storeDecision(key, decision)
+
+	return decision, nil
+}
+
+// query posts the input document to the policy endpoint
+func (a *externalAuthorizer) query(req *http.Request, user *userContext, resource *Resource) (authorizerDecision, error) {
+	headers := make(map[string]string, len(req.Header))
+	for name := range req.Header {
+		// step: do not leak the credentials of the user to the policy endpoint
+		if name == "Authorization" || name == "Cookie" {
+			continue
+		}
+		headers[strings.ToLower(name)] = req.Header.Get(name)
+	}
+	input := authorizerInput{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Headers: headers,
+		User: authorizerUser{
+			ID:       user.id,
+			Username: user.name,
+			Email:    user.email,
+			Roles:    user.roles,
+			Groups:   user.groups,
+		},
+		Claims:   user.claims,
+		Resource: resource,
+	}
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return authorizerDecision{}, err
+	}
+	resp, err := a.client.Post(a.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return authorizerDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return authorizerDecision{}, fmt.Errorf("the policy endpoint returned status: %d", resp.StatusCode)
+	}
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return authorizerDecision{}, fmt.Errorf("unable to decode the policy decision, error: %s", err)
+	}
+	if len(result.Result) <= 0 {
+		return authorizerDecision{}, errors.New("the policy decision has no result, is the policy loaded?")
+	}
+
+	// step: the result is either a boolean or a decision document
+	var decision authorizerDecision
+	if err := json.Unmarshal(result.Result, &decision.Allow); err == nil {
+		return decision, nil
+	}
+	if err := json.Unmarshal(result.Result, &decision); err != nil {
+		return authorizerDecision{}, fmt.Errorf("unable to decode the policy decision, error: %s", err)
+	}
+
+	return decision, nil
+}
+
+// getCacheKey returns the key the decision is cached under, an empty key disables the cache; the
+// elements are method, path, resource, subject, roles, groups, header:NAME and claim:NAME
+func (a *externalAuthorizer) getCacheKey(req *http.Request, user *userContext, resource *Resource) string {
+	if len(a.cacheKey) <= 0 || a.cacheTTL <= 0 {
+		return ""
+	}
+	var items []string
+	for _, x := range a.cacheKey {
+		switch {
+		case x == "method":
+			items = append(items, req.Method)
+		case x == "path":
+			items = append(items, req.URL.Path)
+		case x == "resource":
+			items = append(items, resource.URL)
+		case x == "subject":
+			items = append(items, user.id)
+		case x == "roles":
+			items = append(items, strings.Join(user.roles, ","))
+		case x == "groups":
+			items = append(items, strings.Join(user.groups, ","))
+		case strings.HasPrefix(x, "header:"):
+			items = append(items, req.Header.Get(strings.TrimPrefix(x, "header:")))
+		case strings.HasPrefix(x, "claim:"):
+			items = append(items, strings.Join(getClaimValues(user.claims, strings.TrimPrefix(x, "claim:")), ","))
+		}
+	}
+
+	return strings.Join(items, "\x00")
+}
+
+// getCachedDecision returns the cached decision if any
+func (a *externalAuthorizer) getCachedDecision(key string) (authorizerDecision, bool) {
+	if key == "" {
+		return authorizerDecision{}, false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	cached, found := a.cache[key]
+	if !found || time.Now().After(cached.expires) {
+		return authorizerDecision{}, false
+	}
+
+	return cached.decision, true
+}
+
+// storeDecision caches the decision
+func (a *externalAuthorizer) storeDecision(key string, decision authorizerDecision) {
+	if key == "" {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	if len(a.cache) >= authorizerMaxCacheSize {
+		for k, v := range a.cache {
+			if now.After(v.expires) {
+				delete(a.cache, k)
+			}
+		}
+		// step: if nothing has expired we start again rather than grow unbounded
+		if len(a.cache) >= authorizerMaxCacheSize {
+			a.cache = make(map[string]cachedDecision)
+		}
+	}
+	a.cache[key] = cachedDecision{decision: decision, expires: now.Add(a.cacheTTL)}
+}
+
+// isValidAuthorizerCacheKey checks the element of the cache key is known
+func isValidAuthorizerCacheKey(key string) bool {
+	switch {
+	case containedIn(key, []string{"method", "path", "resource", "subject", "roles", "groups"}):
+		return true
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return true
+	case strings.HasPrefix(key, "claim:") && len(key) > len("claim:"):
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePolicyServer emulates an open policy agent endpoint
+type fakePolicyServer struct {
+	sync.Mutex
+	// the number of queries
+	queries int
+	// the last input received
+	input authorizerInput
+	// the status code to return
+	status int
+	// return the decision as a boolean
+	boolean bool
+}
+
+func (p *fakePolicyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	p.queries++
+
+	var body struct {
+		Input authorizerInput `json:"input"`
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+	p.input = body.Input
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return
+	}
+	allow := containedIn("admin", body.Input.User.Roles) && body.Input.Method != http.MethodDelete
+	if p.boolean {
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": allow})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": map[string]interface{}{
+			"allow":   allow,
+			"headers": map[string]string{"X-Policy-Tenant": "finance"},
+		},
+	})
+}
+
+func (p *fakePolicyServer) getQueries() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.queries
+}
+
+func newTestAuthorizerProxy(policy *fakePolicyServer, cacheKey []string) (*fakeOAuthServer, string) {
+	endpoint := httptest.NewServer(policy)
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.AuthorizerURL = endpoint.URL
+	config.AuthorizerTimeout = time.Duration(5) * time.Second
+	config.AuthorizerCacheKey = cacheKey
+	config.AuthorizerCacheTTL = time.Minute
+	config.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}}}
+	_, idp, svc := newTestProxyService(config)
+
+	return idp, svc
+}
+
+func TestExternalAuthorizer(t *testing.T) {
+	cs := []struct {
+		Method   string
+		Roles    []string
+		Boolean  bool
+		Status   int
+		Expected int
+		Header   string
+	}{
+		{Method: http.MethodGet, Roles: []string{"admin"}, Expected: http.StatusOK, Header: "finance"},
+		{Method: http.MethodDelete, Roles: []string{"admin"}, Expected: http.StatusForbidden},
+		{Method: http.MethodGet, Roles: []string{"user"}, Expected: http.StatusForbidden},
+		{Method: http.MethodGet, Roles: []string{"admin"}, Boolean: true, Expected: http.StatusOK},
+		{Method: http.MethodGet, Roles: []string{"user"}, Boolean: true, Expected: http.StatusForbidden},
+		{Method: http.MethodGet, Roles: []string{"admin"}, Status: http.StatusInternalServerError, Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		policy := &fakePolicyServer{boolean: c.Boolean, status: c.Status}
+		idp, svc := newTestAuthorizerProxy(policy, nil)
+		token := newTestToken(idp.getLocation())
+		token.setRealmsRoles(c.Roles)
+		signed, _ := idp.signToken(token.claims)
+
+		var response testUpstreamResponse
+		resp, err := resty.New().R().
+			SetAuthToken(signed.Encode()).
+			SetHeader("X-Request-Id", "10").
+			SetResult(&response).
+			Execute(c.Method, svc+"/admin")
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+		assert.Equal(t, c.Header, response.Headers.Get("X-Policy-Tenant"), "case %d", i)
+		// step: check the input document
+		assert.Equal(t, c.Method, policy.input.Method, "case %d", i)
+		assert.Equal(t, "/admin", policy.input.Path, "case %d", i)
+		assert.Equal(t, "10", policy.input.Headers["x-request-id"], "case %d", i)
+		assert.Empty(t, policy.input.Headers["authorization"], "case %d", i)
+		assert.Equal(t, "/admin", policy.input.Resource.URL, "case %d", i)
+		assert.NotEmpty(t, policy.input.Claims, "case %d", i)
+	}
+}
+
+func TestExternalAuthorizerCache(t *testing.T) {
+	policy := &fakePolicyServer{}
+	idp, svc := newTestAuthorizerProxy(policy, []string{"subject", "method", "path"})
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{"admin"})
+	signed, _ := idp.signToken(token.claims)
+
+	for i := 0; i < 5; i++ {
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + "/admin")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+	assert.Equal(t, 1, policy.getQueries())
+
+	// step: a different method is a different key
+	resp, err := resty.New().R().SetAuthToken(signed.Encode()).Delete(svc + "/admin")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+	assert.Equal(t, 2, policy.getQueries())
+}
+
+func TestExternalAuthorizerErrorMetric(t *testing.T) {
+	policy := &fakePolicyServer{status: http.StatusServiceUnavailable}
+	authorizer := newExternalAuthorizer(&Config{AuthorizerURL: httptest.NewServer(policy).URL})
+	req, _ := http.NewRequest(http.MethodGet, "/admin", nil)
+	user := &userContext{id: "test"}
+	errors := func() float64 {
+		var metric dto.Metric
+		authorizer.errors.Write(&metric)
+		return metric.GetCounter().GetValue()
+	}
+	current := errors()
+	for i := 0; i < 3; i++ {
+		_, err := authorizer.authorize(req, user, &Resource{URL: "/admin"})
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 3, policy.getQueries())
+	assert.Equal(t, current+3, errors())
+}
+
+func TestIsValidAuthorizerCacheKey(t *testing.T) {
+	for _, x := range []string{"method", "path", "resource", "subject", "roles", "groups", "header:X-Tenant", "claim:tenant"} {
+		assert.True(t, isValidAuthorizerCacheKey(x), "key: %s should be valid", x)
+	}
+	for _, x := range []string{"", "user", "header:", "claim:"} {
+		assert.False(t, isValidAuthorizerCacheKey(x), "key: %s should be invalid", x)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// claimMapping describes where the identity of the user is found within the claims of the token
+type claimMapping struct {
+	// the path of the claim holding the username
+	username string
+	// the path of the claim holding the email
+	email string
+	// the path of the claim holding the groups
+	groups string
+	// the claims holding the roles, if empty the keycloak realm and client roles are used
+	roles []roleClaim
+}
+
+// roleClaim is the path of a claim holding roles and the prefix added to them
+type roleClaim struct {
+	// the path of the claim
+	path string
+	// the prefix added to the roles
+	prefix string
+}
+
+// defaultClaimMapping is the mapping of the claims issued by keycloak
+var defaultClaimMapping = &claimMapping{
+	username: claimPreferredName,
+	email:    claimEmail,
+	groups:   claimGroups,
+}
+
+// newClaimMapping creates the claim mapping from the configuration
+func newClaimMapping(config *Config) (*claimMapping, error) {
+	mapping := &claimMapping{
+		username: defaultClaimMapping.username,
+		email:    defaultClaimMapping.email,
+		groups:   defaultClaimMapping.groups,
+	}
+	if config.UsernameClaim != "" {
+		mapping.username = config.UsernameClaim
+	}
+	if config.EmailClaim != "" {
+		mapping.email = config.EmailClaim
+	}
+	if config.GroupsClaim != "" {
+		mapping.groups = config.GroupsClaim
+	}
+	for _, x := range config.RoleClaims {
+		claim, err := parseRoleClaim(x)
+		if err != nil {
+			return nil, err
+		}
+		mapping.roles = append(mapping.roles, claim)
+	}
+
+	return mapping, nil
+}
+
+// parseRoleClaim parses the role claim in the form PATH[=PREFIX]
+func parseRoleClaim(value string) (roleClaim, error) {
+	items := strings.SplitN(value, "=", 2)
+	claim := roleClaim{path: strings.TrimSpace(items[0])}
+	if len(items) > 1 {
+		claim.prefix = items[1]
+	}
+	if claim.path == "" || strings.HasPrefix(claim.path, ".") || strings.HasSuffix(claim.path, ".") {
+		return roleClaim{}, fmt.Errorf("the role claim: '%s' is invalid, should be PATH[=PREFIX]", value)
+	}
+
+	return claim, nil
+}
+
+// getUsername returns the username from the claims
+func (r *claimMapping) getUsername(claims jose.Claims) string {
+	return getFirstClaimValue(claims, r.username)
+}
+
+// getEmail returns the email from the claims
+func (r *claimMapping) getEmail(claims jose.Claims) string {
+	return getFirstClaimValue(claims, r.email)
+}
+
+// getGroups returns the groups from the claims
+func (r *claimMapping) getGroups(claims jose.Claims) []string {
+	return getClaimValues(claims, r.groups)
+}
+
+// getRoles returns the roles from the claims
+func (r *claimMapping) getRoles(claims jose.Claims) []string {
+	if len(r.roles) <= 0 {
+		return getKeycloakRoles(claims)
+	}
+	var list []string
+	for _, x := range r.roles {
+		for _, role := range getClaimValues(claims, x.path) {
+			list = append(list, x.prefix+role)
+		}
+	}
+
+	return list
+}
+
+// getKeycloakRoles returns the realm and client roles from a keycloak token
+func getKeycloakRoles(claims jose.Claims) []string {
+	var list []string
+	// step: extract the realm roles
+	if realmRoles, found := claims[claimRealmAccess].(map[string]interface{}); found {
+		if roles, found := realmRoles[claimResourceRoles]; found {
+			for _, r := range roles.([]interface{}) {
+				list = append(list, fmt.Sprintf("%s", r))
+			}
+		}
+	}
+
+	// step: extract the roles from the access token
+	if accesses, found := claims[claimResourceAccess].(map[string]interface{}); found {
+		for roleName, roleList := range accesses {
+			scopes := roleList.(map[string]interface{})
+			if roles, found := scopes[claimResourceRoles]; found {
+				for _, r := range roles.([]interface{}) {
+					list = append(list, fmt.Sprintf("%s:%s", roleName, r))
+				}
+			}
+		}
+	}
+
+	return list
+}
+
+// claimMatcher checks the values of a claim; the matcher is either a regex, which must match the
+// complete value, a list membership i.e. in(a, b) or a numeric comparison i.e. >=3, <10, ==2, !=0
+type claimMatcher struct {
+	// the operator of the matcher
+	operator string
+	// the regex the values must match
+	regex *regexp.Regexp
+	// the values for the list membership
+	values []string
+	// the number for a numeric comparison
+	number float64
+}
+
+// parseClaimMatcher parses the claim matcher
+func parseClaimMatcher(value string) (*claimMatcher, error) {
+	if strings.HasPrefix(value, "in(") && strings.HasSuffix(value, ")") {
+		var values []string
+		for _, x := range strings.Split(value[3:len(value)-1], ",") {
+			values = append(values, strings.TrimSpace(x))
+		}
+		return &claimMatcher{operator: "in", values: values}, nil
+	}
+	for _, operator := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if !strings.HasPrefix(value, operator) {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(value[len(operator):]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("the value of the %s comparison is not a number", operator)
+		}
+		return &claimMatcher{operator: operator, number: number}, nil
+	}
+	regex, err := regexp.Compile("^(?:" + value + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	return &claimMatcher{operator: "regex", regex: regex}, nil
+}
+
+// matches checks if any of the values of the claim satisfy the matcher
+func (m *claimMatcher) matches(values []string) bool {
+	for _, x := range values {
+		switch m.operator {
+		case "regex":
+			if m.regex.MatchString(x) {
+				return true
+			}
+		case "in":
+			if containedIn(x, m.values) {
+				return true
+			}
+		default:
+			number, err := strconv.ParseFloat(x, 64)
+			if err != nil {
+				continue
+			}
+			if compareNumbers(m.operator, number, m.number) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// compareNumbers compares the numbers by the operator
+func compareNumbers(operator string, a, b float64) bool {
+	switch operator {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	}
+
+	return false
+}
+
+// getFirstClaimValue returns the first value found at the path in the claims
+func getFirstClaimValue(claims jose.Claims, path string) string {
+	if values := getClaimValues(claims, path); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// getClaimValues returns the values found at the dot notation path in the claims, a * in the path
+// matches any key and arrays are flattened
+func getClaimValues(claims jose.Claims, path string) []string {
+	var list []string
+	for _, x := range lookupClaimPath(map[string]interface{}(claims), strings.Split(path, ".")) {
+		switch v := x.(type) {
+		case []interface{}:
+			for _, item := range v {
+				if value, found := claimValueString(item); found {
+					list = append(list, value)
+				}
+			}
+		default:
+			if value, found := claimValueString(v); found {
+				list = append(list, value)
+			}
+		}
+	}
+
+	return list
+}
+
+// lookupClaimPath walks the path of the claims, returning the values found
+func lookupClaimPath(value interface{}, path []string) []interface{} {
+	if len(path) <= 0 {
+		return []interface{}{value}
+	}
+	var list []interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// step: claims with dots in the name i.e. namespaced claims take precedence
+		if x, found := v[strings.Join(path, ".")]; found && len(path) > 1 {
+			return []interface{}{x}
+		}
+		if path[0] == "*" {
+			var keys []string
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				list = append(list, lookupClaimPath(v[k], path[1:])...)
+			}
+			return list
+		}
+		if x, found := v[path[0]]; found {
+			return lookupClaimPath(x, path[1:])
+		}
+	case []interface{}:
+		for _, x := range v {
+			list = append(list, lookupClaimPath(x, path)...)
+		}
+	}
+
+	return list
+}
+
+// claimValueString converts a scalar claim value to a string
+func claimValueString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		// step: avoid the exponent notation of %v for large numbers i.e. ids
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool, int, int64:
+		return fmt.Sprintf("%v", v), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClaimValues(t *testing.T) {
+	claims := jose.Claims{
+		"email": "gambol99@gmail.com",
+		"roles": []interface{}{"admin", "user"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"realm"},
+		},
+		"resource_access": map[string]interface{}{
+			"b": map[string]interface{}{"roles": []interface{}{"b1"}},
+			"a": map[string]interface{}{"roles": []interface{}{"a1", "a2"}},
+		},
+		"https://example.com/roles": []interface{}{"namespaced"},
+		"groups":                    []interface{}{map[string]interface{}{"name": "dev"}, map[string]interface{}{"name": "ops"}},
+		"level":                     float64(2),
+		"tenant_id":                 float64(1234567),
+		"ratio":                     float64(0.25),
+		"ids":                       []interface{}{float64(98765432101), float64(3)},
+	}
+	cs := []struct {
+		Path     string
+		Expected []string
+	}{
+		{Path: "email", Expected: []string{"gambol99@gmail.com"}},
+		{Path: "roles", Expected: []string{"admin", "user"}},
+		{Path: "realm_access.roles", Expected: []string{"realm"}},
+		{Path: "resource_access.*.roles", Expected: []string{"a1", "a2", "b1"}},
+		{Path: "resource_access.a.roles", Expected: []string{"a1", "a2"}},
+		{Path: "https://example.com/roles", Expected: []string{"namespaced"}},
+		{Path: "groups.name", Expected: []string{"dev", "ops"}},
+		{Path: "level", Expected: []string{"2"}},
+		{Path: "tenant_id", Expected: []string{"1234567"}},
+		{Path: "ratio", Expected: []string{"0.25"}},
+		{Path: "ids", Expected: []string{"98765432101", "3"}},
+		{Path: "realm_access"},
+		{Path: "missing"},
+		{Path: "email.missing"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, getClaimValues(claims, c.Path), "case %d, path: %s", i, c.Path)
+	}
+}
+
+func TestParseRoleClaim(t *testing.T) {
+	cs := []struct {
+		Value    string
+		Expected roleClaim
+		Ok       bool
+	}{
+		{Value: "roles", Expected: roleClaim{path: "roles"}, Ok: true},
+		{Value: "groups=dex:", Expected: roleClaim{path: "groups", prefix: "dex:"}, Ok: true},
+		{Value: "resource_access.*.roles=", Expected: roleClaim{path: "resource_access.*.roles"}, Ok: true},
+		{Value: ""},
+		{Value: "=prefix"},
+		{Value: "roles."},
+	}
+	for i, c := range cs {
+		claim, err := parseRoleClaim(c.Value)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, c.Expected, claim, "case %d", i)
+		}
+	}
+}
+
+func TestClaimMatcher(t *testing.T) {
+	cs := []struct {
+		Matcher  string
+		Values   []string
+		Expected bool
+	}{
+		{Matcher: "^finance$", Values: []string{"finance"}, Expected: true},
+		{Matcher: "^finance$", Values: []string{"finance-eu"}},
+		{Matcher: "fin.*", Values: []string{"sales", "finance"}, Expected: true},
+		{Matcher: "admin", Values: []string{"admin"}, Expected: true},
+		{Matcher: "admin", Values: []string{"notadmin", "admins"}},
+		{Matcher: "admin|auditor", Values: []string{"auditor"}, Expected: true},
+		{Matcher: "admin|auditor", Values: []string{"auditors"}},
+		{Matcher: "in(finance,sales)", Values: []string{"sales"}, Expected: true},
+		{Matcher: "in(finance, sales)", Values: []string{"sales"}, Expected: true},
+		{Matcher: "in( finance , sales )", Values: []string{"finance"}, Expected: true},
+		{Matcher: "in(finance,sales)", Values: []string{"hr", "finance"}, Expected: true},
+		{Matcher: "in(finance,sales)", Values: []string{"hr"}},
+		{Matcher: ">=3", Values: []string{"3"}, Expected: true},
+		{Matcher: ">=3", Values: []string{"2"}},
+		{Matcher: ">3", Values: []string{"3"}},
+		{Matcher: "<10", Values: []string{"9.5"}, Expected: true},
+		{Matcher: "<=10", Values: []string{"11"}},
+		{Matcher: "==2", Values: []string{"2"}, Expected: true},
+		{Matcher: "!=0", Values: []string{"0"}},
+		{Matcher: ">=3", Values: []string{"high"}},
+		{Matcher: "^finance$"},
+		{Matcher: ">=3"},
+	}
+	for i, c := range cs {
+		matcher, err := parseClaimMatcher(c.Matcher)
+		if !assert.NoError(t, err, "case %d, matcher: %s", i, c.Matcher) {
+			continue
+		}
+		assert.Equal(t, c.Expected, matcher.matches(c.Values), "case %d, matcher: %s, values: %s", i, c.Matcher, c.Values)
+	}
+	for _, x := range []string{">=high", "<", "[a-"} {
+		_, err := parseClaimMatcher(x)
+		assert.Error(t, err, "matcher: %s should have failed", x)
+	}
+}
+
+func TestResourceClaimsAdmission(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.Resources = []*Resource{
+		{
+			URL:     "/finance",
+			Methods: []string{"ANY"},
+			Claims:  map[string]string{"tenant": "^finance$", "level": ">=3"},
+		},
+		{
+			URL:     "/regions",
+			Methods: []string{"ANY"},
+			Claims:  map[string]string{"address.region": "in(eu,uk)"},
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	}
+	_, idp, svc := newTestProxyService(config)
+	cs := []struct {
+		URL      string
+		Claims   jose.Claims
+		Expected int
+	}{
+		{URL: "/finance", Claims: jose.Claims{"tenant": "finance", "level": float64(3)}, Expected: http.StatusOK},
+		{URL: "/finance", Claims: jose.Claims{"tenant": "finance", "level": float64(1)}, Expected: http.StatusForbidden},
+		{URL: "/finance", Claims: jose.Claims{"tenant": "sales", "level": float64(5)}, Expected: http.StatusForbidden},
+		{URL: "/finance", Claims: jose.Claims{"tenant": "finance"}, Expected: http.StatusForbidden},
+		{URL: "/regions", Claims: jose.Claims{"address": map[string]interface{}{"region": "uk"}}, Expected: http.StatusOK},
+		{URL: "/regions", Claims: jose.Claims{"address": map[string]interface{}{"region": "us"}}, Expected: http.StatusForbidden},
+		{URL: "/", Claims: jose.Claims{"tenant": "sales"}, Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		token.mergeClaims(c.Claims)
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s, expected: %d", i, c.URL, c.Expected)
+	}
+}
+
+func TestExtractIdentityClaimMapping(t *testing.T) {
+	claims := jose.Claims{
+		"sub":   "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"aud":   "test",
+		"name":  "rohith",
+		"upn":   "rohith@example.com",
+		"roles": []interface{}{"admin"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"realm"},
+		},
+	}
+	mapping, err := newClaimMapping(&Config{
+		UsernameClaim: "name",
+		EmailClaim:    "upn",
+		RoleClaims:    []string{"roles=azure:", "realm_access.roles"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	user, err := extractIdentity(newFakeAccessToken(&claims, 0), mapping)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "rohith", user.name)
+	assert.Equal(t, "rohith@example.com", user.email)
+	assert.Equal(t, []string{"azure:admin", "realm"}, user.roles)
+
+	// step: the username should fallback to the email
+	delete(claims, "name")
+	user, err = extractIdentity(newFakeAccessToken(&claims, 0), mapping)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "rohith@example.com", user.name)
+	}
+}
+
+func TestRoleClaimsAdmission(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.RoleClaims = []string{"groups=dex:"}
+	config.Resources = []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+			Roles:   []string{"dex:admin"},
+		},
+	}
+	_, idp, svc := newTestProxyService(config)
+	cs := []struct {
+		Groups   []interface{}
+		Expected int
+	}{
+		{Groups: []interface{}{"admin"}, Expected: http.StatusOK},
+		{Groups: []interface{}{"user"}, Expected: http.StatusForbidden},
+		{Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		token.setRealmsRoles([]string{"dex:admin"})
+		if c.Groups != nil {
+			token.claims.Add("groups", c.Groups)
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + "/admin")
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+	}
+}
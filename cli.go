@@ -169,8 +169,9 @@ func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
 			case reflect.String:
 				reflect.ValueOf(config).Elem().FieldByName(field.Name).SetString(cx.String(name))
 			case reflect.Slice:
+				value := reflect.ValueOf(config).Elem().FieldByName(field.Name)
 				for _, x := range cx.StringSlice(name) {
-					reflect.Append(reflect.ValueOf(config).Elem().FieldByName(field.Name), reflect.ValueOf(x))
+					value.Set(reflect.Append(value, reflect.ValueOf(x)))
 				}
 			case reflect.Int64:
 				switch field.Type.String() {
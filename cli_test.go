@@ -18,6 +18,7 @@ package main
 import (
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/urfave/cli"
 )
 
@@ -36,3 +37,33 @@ func TestReadOptions(t *testing.T) {
 	}
 	c.Run([]string{""})
 }
+
+func TestReadSliceOptions(t *testing.T) {
+	config := &Config{}
+	c := cli.NewApp()
+	c.Flags = getCommandLineOptions()
+	c.Action = func(cx *cli.Context) error {
+		return parseCLIOptions(cx, config)
+	}
+	assert.NoError(t, c.Run([]string{"", "--scopes=openid", "--scopes=email", "--public-key-files=keys.json"}))
+	assert.Equal(t, []string{"openid", "email"}, config.Scopes)
+	assert.Equal(t, []string{"keys.json"}, config.PublicKeyFiles)
+}
+
+func TestReadResourceOptions(t *testing.T) {
+	config := &Config{}
+	c := cli.NewApp()
+	c.Flags = getCommandLineOptions()
+	c.Action = func(cx *cli.Context) error {
+		return parseCLIOptions(cx, config)
+	}
+	assert.NoError(t, c.Run([]string{"",
+		"--resources=uri=/admin|expression=role:admin || role:auditor|methods=GET",
+		"--resources=uri=/finance|when=request.method == 'GET' || has(claims.tenant)",
+	}))
+	if assert.Len(t, config.Resources, 2) {
+		assert.Equal(t, "role:admin || role:auditor", config.Resources[0].Expression)
+		assert.Equal(t, []string{"GET"}, config.Resources[0].Methods)
+		assert.Equal(t, "request.method == 'GET' || has(claims.tenant)", config.Resources[1].When)
+	}
+}
@@ -32,10 +32,13 @@ func newDefaultConfig() *Config {
 		MatchClaims:                 make(map[string]string, 0),
 		Headers:                     make(map[string]string, 0),
 		UpstreamTimeout:             time.Duration(10) * time.Second,
+		AuthorizerTimeout:           time.Duration(5) * time.Second,
 		UpstreamKeepaliveTimeout:    time.Duration(10) * time.Second,
 		EnableAuthorizationHeader:   true,
 		CookieAccessName:            "kc-access",
 		CookieRefreshName:           "kc-state",
+		CSRFCookieName:              "kc-csrf",
+		CSRFHeaderName:              "X-CSRF-Token",
 		SecureCookie:                true,
 		SkipUpstreamTLSVerify:       true,
 		SkipOpenIDProviderTLSVerify: false,
@@ -97,8 +100,19 @@ func (r *Config) isValid() error {
 			if r.ClientID == "" {
 				return errors.New("you have not specified the client id")
 			}
-			if r.DiscoveryURL == "" {
-				return errors.New("you have not specified the discovery url")
+			if r.DiscoveryURL == "" && len(r.PublicKeyFiles) <= 0 {
+				return errors.New("you have not specified the discovery url or public key files")
+			}
+			for _, filename := range r.PublicKeyFiles {
+				if !fileExists(filename) {
+					return fmt.Errorf("the public key file %s does not exist", filename)
+				}
+			}
+			if len(r.PublicKeyFiles) > 0 && r.TokenIssuer == "" {
+				return errors.New("you have not specified the token issuer for the public key files")
+			}
+			if r.DiscoveryURL == "" && (r.EnableRefreshTokens || r.EnableLoginHandler || r.EnableNotBeforePush) {
+				return errors.New("refresh tokens, the login handler and not-before push require a discovery url")
 			}
 			if strings.HasSuffix(r.RedirectionURL, "/") {
 				r.RedirectionURL = strings.TrimSuffix(r.RedirectionURL, "/")
@@ -129,12 +143,58 @@ func (r *Config) isValid() error {
 			if !r.NoRedirects && r.SecureCookie && r.RedirectionURL != "" && !strings.HasPrefix(r.RedirectionURL, "https") {
 				return errors.New("the cookie is set to secure but your redirection url is non-tls")
 			}
+			if _, err := newCorsPolicy(Cors{Origins: r.CorsOrigins, Credentials: r.CorsCredentials}); err != nil {
+				return err
+			}
+			if r.EnableCSRF && (r.CSRFCookieName == "" || r.CSRFHeaderName == "") {
+				return errors.New("the csrf protection requires a cookie and header name")
+			}
+			for _, x := range r.RedirectionHosts {
+				host, err := parseRedirectionHost(x)
+				if err != nil {
+					return err
+				}
+				if !r.NoRedirects && r.SecureCookie && host.scheme == "http" {
+					return fmt.Errorf("the cookie is set to secure but the redirection host: %s is non-tls", x)
+				}
+			}
+			if r.RefreshWindow != "" {
+				if !r.EnableRefreshTokens {
+					return errors.New("the refresh window requires refresh tokens to be enabled")
+				}
+				if _, _, err := parseRefreshWindow(r.RefreshWindow); err != nil {
+					return err
+				}
+			}
 			if r.StoreURL != "" {
 				if _, err := url.Parse(r.StoreURL); err != nil {
 					return fmt.Errorf("the store url is invalid, error: %s", err)
 				}
 			}
 		}
+		if r.ClockSkew < 0 {
+			return errors.New("the clock skew cannot be negative")
+		}
+		if r.AuthorizerURL != "" {
+			if _, err := url.Parse(r.AuthorizerURL); err != nil {
+				return fmt.Errorf("the authorizer url is invalid, error: %s", err)
+			}
+			for _, x := range r.AuthorizerCacheKey {
+				if !isValidAuthorizerCacheKey(x) {
+					return fmt.Errorf("the authorizer cache key: %s is invalid", x)
+				}
+			}
+		}
+		for _, x := range [][]string{r.AllowedCIDRs, r.DeniedCIDRs, r.TrustedProxies} {
+			if _, err := parseCIDRs(x); err != nil {
+				return err
+			}
+		}
+		for _, x := range r.RoleClaims {
+			if _, err := parseRoleClaim(x); err != nil {
+				return err
+			}
+		}
 		// check: ensure each of the resource are valid
 		for _, resource := range r.Resources {
 			if err := resource.valid(); err != nil {
@@ -152,6 +212,11 @@ func (r *Config) isValid() error {
 	return nil
 }
 
+// getIssuer returns the issuer of the provider, the discovery url without the well-known suffix
+func (r *Config) getIssuer() string {
+	return strings.TrimSuffix(strings.TrimSuffix(r.DiscoveryURL, "/.well-known/openid-configuration"), "/")
+}
+
 // hasCustomSignInPage checks if there is a custom sign in  page
 func (r *Config) hasCustomSignInPage() bool {
 	if r.SignInPage != "" {
@@ -17,6 +17,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestNewDefaultConfig(t *testing.T) {
@@ -78,6 +79,44 @@ func TestIsConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				ClientID:       "client",
+				PublicKeyFiles: []string{testCertificateFile},
+				TokenIssuer:    "http://127.0.0.1:8080",
+				Upstream:       "http://120.0.0.1",
+			},
+			Ok: true,
+		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				ClientID:       "client",
+				PublicKeyFiles: []string{testCertificateFile},
+				Upstream:       "http://120.0.0.1",
+			},
+		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				ClientID:       "client",
+				PublicKeyFiles: []string{"./tests/does_not_exist"},
+				TokenIssuer:    "http://127.0.0.1:8080",
+				Upstream:       "http://120.0.0.1",
+			},
+		},
+		{
+			Config: &Config{
+				Listen:              ":8080",
+				ClientID:            "client",
+				PublicKeyFiles:      []string{testCertificateFile},
+				TokenIssuer:         "http://127.0.0.1:8080",
+				Upstream:            "http://120.0.0.1",
+				EnableRefreshTokens: true,
+				EncryptionKey:       "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j",
+			},
+		},
 		{
 			Config: &Config{
 				Listen:                ":8080",
@@ -137,6 +176,87 @@ func TestIsConfig(t *testing.T) {
 			},
 			Ok: true,
 		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				DiscoveryURL:   "http://127.0.0.1:8080",
+				ClientID:       "client",
+				ClientSecret:   "client",
+				RedirectionURL: "https://120.0.0.1",
+				Upstream:       "http://127.0.0.1",
+				ClockSkew:      time.Duration(30) * time.Second,
+			},
+			Ok: true,
+		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				DiscoveryURL:   "http://127.0.0.1:8080",
+				ClientID:       "client",
+				ClientSecret:   "client",
+				RedirectionURL: "https://120.0.0.1",
+				Upstream:       "http://127.0.0.1",
+				AllowedCIDRs:   []string{"10.0.0.0/8"},
+				DeniedCIDRs:    []string{"10.1.1.1"},
+				TrustedProxies: []string{"127.0.0.1", "172.16.0.0/12"},
+			},
+			Ok: true,
+		},
+		{
+			Config: &Config{
+				Listen:         ":8080",
+				DiscoveryURL:   "http://127.0.0.1:8080",
+				ClientID:       "client",
+				ClientSecret:   "client",
+				RedirectionURL: "https://120.0.0.1",
+				Upstream:       "http://127.0.0.1",
+				TrustedProxies: []string{"not a cidr"},
+			},
+		},
+		{
+			Config: &Config{
+				Listen:           ":8080",
+				DiscoveryURL:     "http://127.0.0.1:8080",
+				ClientID:         "client",
+				ClientSecret:     "client",
+				Upstream:         "http://127.0.0.1",
+				RedirectionHosts: []string{"https://app.example.com", "other.example.com"},
+			},
+			Ok: true,
+		},
+		{
+			Config: &Config{
+				Listen:           ":8080",
+				DiscoveryURL:     "http://127.0.0.1:8080",
+				ClientID:         "client",
+				ClientSecret:     "client",
+				Upstream:         "http://127.0.0.1",
+				RedirectionHosts: []string{"ftp://app.example.com"},
+			},
+		},
+		{
+			Config: &Config{
+				Listen:          ":8080",
+				DiscoveryURL:    "http://127.0.0.1:8080",
+				ClientID:        "client",
+				ClientSecret:    "client",
+				Upstream:        "http://127.0.0.1",
+				CorsOrigins:     []string{"https://app.example.com"},
+				CorsCredentials: true,
+			},
+			Ok: true,
+		},
+		{
+			Config: &Config{
+				Listen:          ":8080",
+				DiscoveryURL:    "http://127.0.0.1:8080",
+				ClientID:        "client",
+				ClientSecret:    "client",
+				Upstream:        "http://127.0.0.1",
+				CorsOrigins:     []string{"*"},
+				CorsCredentials: true,
+			},
+		},
 	}
 
 	for i, c := range tests {
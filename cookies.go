@@ -25,6 +25,11 @@ import (
 
 // dropCookie drops a cookie into the response
 func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration time.Duration) {
+	http.SetCookie(cx.Writer, r.newCookie(cx, name, value, duration))
+}
+
+// newCookie creates a cookie for the response
+func (r *oauthProxy) newCookie(cx *gin.Context, name, value string, duration time.Duration) *http.Cookie {
 	// step: default to the host header, else the config domain
 	domain := strings.Split(cx.Request.Host, ":")[0]
 	if r.config.CookieDomain != "" {
@@ -42,7 +47,7 @@ func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration ti
 		cookie.Expires = time.Now().Add(duration)
 	}
 
-	http.SetCookie(cx.Writer, cookie)
+	return cookie
 }
 
 // dropAccessTokenCookie drops a access token cookie into the response
@@ -55,10 +60,46 @@ func (r *oauthProxy) dropRefreshTokenCookie(cx *gin.Context, value string, durat
 	r.dropCookie(cx, r.config.CookieRefreshName, value, duration)
 }
 
+// dropSilentAuthCookie drops the cookie marking a silent authorization attempt
+func (r *oauthProxy) dropSilentAuthCookie(cx *gin.Context) {
+	r.dropCookie(cx, silentCookieName, "true", time.Duration(1)*time.Minute)
+}
+
+// clearSilentAuthCookie clears the silent authorization cookie
+func (r *oauthProxy) clearSilentAuthCookie(cx *gin.Context) {
+	r.dropCookie(cx, silentCookieName, "", time.Duration(-10*time.Hour))
+}
+
+// dropStepUpCookie drops the cookie marking a step up authorization attempt
+func (r *oauthProxy) dropStepUpCookie(cx *gin.Context) {
+	r.dropCookie(cx, stepUpCookieName, "true", time.Duration(1)*time.Minute)
+}
+
+// clearStepUpCookie clears the step up authorization cookie
+func (r *oauthProxy) clearStepUpCookie(cx *gin.Context) {
+	r.dropCookie(cx, stepUpCookieName, "", time.Duration(-10*time.Hour))
+}
+
+// dropCSRFCookie drops the csrf token cookie, which must be readable by the client side scripts
+func (r *oauthProxy) dropCSRFCookie(cx *gin.Context, value string) {
+	cookie := r.newCookie(cx, r.config.CSRFCookieName, value, 0)
+	cookie.HttpOnly = false
+
+	http.SetCookie(cx.Writer, cookie)
+}
+
 // clearAllCookies is just a helper function for the below
 func (r *oauthProxy) clearAllCookies(cx *gin.Context) {
 	r.clearAccessTokenCookie(cx)
 	r.clearRefreshTokenCookie(cx)
+	if r.config.EnableCSRF {
+		r.clearCSRFCookie(cx)
+	}
+}
+
+// clearCSRFCookie clears the csrf token cookie
+func (r *oauthProxy) clearCSRFCookie(cx *gin.Context) {
+	r.dropCookie(cx, r.config.CSRFCookieName, "", time.Duration(-10*time.Hour))
 }
 
 // clearRefreshSessionCookie clears the session cookie
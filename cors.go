@@ -0,0 +1,133 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// corsPolicy is the compiled cors options
+type corsPolicy struct {
+	Cors
+	// any origin is permitted
+	any bool
+	// the origins permitted, lowercased
+	origins map[string]bool
+	// the origin patterns, i.e. https://*.example.com or ~^https://.*\.example\.com$
+	patterns []*regexp.Regexp
+}
+
+// newCorsPolicy compiles the cors options; the any origin cannot be combined with credentials, as
+// it would permit any site to read the responses of an authenticated user, and the regexes are
+// anchored to match the complete origin
+func newCorsPolicy(c Cors) (*corsPolicy, error) {
+	p := &corsPolicy{Cors: c, origins: make(map[string]bool)}
+	for _, x := range c.Origins {
+		switch {
+		case x == "*":
+			if c.Credentials {
+				return nil, errors.New("the cors origin * cannot be used with credentials, the origins must be listed")
+			}
+			p.any = true
+		case strings.HasPrefix(x, "~"):
+			regex, err := regexp.Compile("^(?:" + strings.TrimPrefix(x, "~") + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid cors origin regex: %s, error: %s", x, err)
+			}
+			p.patterns = append(p.patterns, regex)
+		case strings.Contains(x, "*"):
+			// step: a wildcard matches one or more labels of the hostname
+			expr := strings.Replace(regexp.QuoteMeta(strings.ToLower(x)), `\*`, `[a-z0-9-]+(\.[a-z0-9-]+)*`, -1)
+			p.patterns = append(p.patterns, regexp.MustCompile("^"+expr+"$"))
+		default:
+			p.origins[strings.ToLower(strings.TrimSuffix(x, "/"))] = true
+		}
+	}
+
+	return p, nil
+}
+
+// isPermitted checks the origin is permitted by the policy
+func (p *corsPolicy) isPermitted(origin string) bool {
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, x := range p.patterns {
+		if x.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inject adds the cors headers to the response; the origin of the request is reflected when
+// permitted, as the header can only hold a single origin, unless any is permitted. The methods,
+// headers and max age are only added to the preflight responses.
+func (p *corsPolicy) inject(header http.Header, req *http.Request, preflight bool) {
+	origin := req.Header.Get("Origin")
+	if !p.any {
+		header.Add("Vary", "Origin")
+	}
+	switch {
+	case p.any:
+		header.Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && p.isPermitted(origin):
+		header.Set("Access-Control-Allow-Origin", origin)
+	default:
+		return
+	}
+	if p.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(p.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ","))
+		}
+		return
+	}
+
+	// step: the methods and headers default to those requested
+	methods := strings.Join(p.Methods, ",")
+	if methods == "" {
+		methods = req.Header.Get("Access-Control-Request-Method")
+	}
+	header.Set("Access-Control-Allow-Methods", methods)
+	headers := strings.Join(p.Headers, ",")
+	if headers == "" {
+		headers = req.Header.Get("Access-Control-Request-Headers")
+	}
+	if headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if p.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(p.MaxAge.Seconds())))
+	}
+}
+
+// isPreflightRequest checks if the request is a cors preflight
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCorsPolicy(t *testing.T) {
+	cs := []struct {
+		Origins     []string
+		Credentials bool
+		Ok          bool
+	}{
+		{Origins: []string{"*"}, Ok: true},
+		{Origins: []string{"https://app.example.com", "https://*.example.com"}, Ok: true},
+		{Origins: []string{`~^https://[a-z]+\.example\.com$`}, Ok: true},
+		{Origins: []string{"~^https://(example.com"}},
+		{Origins: []string{"https://app.example.com"}, Credentials: true, Ok: true},
+		{Origins: []string{"*"}, Credentials: true},
+		{Origins: []string{"https://app.example.com", "*"}, Credentials: true},
+	}
+	for i, c := range cs {
+		_, err := newCorsPolicy(Cors{Origins: c.Origins, Credentials: c.Credentials})
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have failed", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestCorsPolicyIsPermitted(t *testing.T) {
+	policy, err := newCorsPolicy(Cors{Origins: []string{
+		"https://app.example.com/",
+		"https://*.example.org",
+		`~^http://localhost:[0-9]+$`,
+		`~https://.*\.example\.net`,
+	}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Origin   string
+		Expected bool
+	}{
+		{Origin: "https://app.example.com", Expected: true},
+		{Origin: "HTTPS://App.Example.com", Expected: true},
+		{Origin: "http://app.example.com"},
+		{Origin: "https://app.example.com.evil.com"},
+		{Origin: "https://www.example.org", Expected: true},
+		{Origin: "https://a.b.example.org", Expected: true},
+		{Origin: "https://example.org"},
+		{Origin: "https://evil.com/.example.org"},
+		{Origin: "https://evilexample.org"},
+		{Origin: "http://localhost:3000", Expected: true},
+		{Origin: "http://localhost:3000.evil.com"},
+		{Origin: "null"},
+		{Origin: "https://a.example.net", Expected: true},
+		{Origin: "https://a.example.net.evil.com"},
+		{Origin: "https://a.example.net:8443"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, policy.isPermitted(c.Origin), "case %d, origin: %s", i, c.Origin)
+	}
+}
+
+func TestCorsPolicyInject(t *testing.T) {
+	cs := []struct {
+		Cors      Cors
+		Origin    string
+		Preflight bool
+		Headers   map[string]string
+	}{
+		{
+			Cors:    Cors{Origins: []string{"*"}},
+			Origin:  "https://any.com",
+			Headers: map[string]string{"Access-Control-Allow-Origin": "*", "Vary": ""},
+		},
+		{
+			Cors:    Cors{Origins: []string{"https://*.example.com"}, Credentials: true},
+			Origin:  "https://app.example.com",
+			Headers: map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Credentials": "true", "Vary": "Origin"},
+		},
+		{
+			Cors:    Cors{Origins: []string{"https://a.com", "https://b.com"}},
+			Origin:  "https://b.com",
+			Headers: map[string]string{"Access-Control-Allow-Origin": "https://b.com", "Vary": "Origin"},
+		},
+		{
+			Cors:    Cors{Origins: []string{"https://a.com"}, Credentials: true, Methods: []string{"GET"}},
+			Origin:  "https://evil.com",
+			Headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": "", "Vary": "Origin"},
+		},
+		{
+			Cors:    Cors{Origins: []string{"https://a.com"}, Methods: []string{"GET", "POST"}, ExposedHeaders: []string{"X-Id"}},
+			Origin:  "https://a.com",
+			Headers: map[string]string{"Access-Control-Allow-Methods": "", "Access-Control-Expose-Headers": "X-Id"},
+		},
+		{
+			Cors: Cors{
+				Origins: []string{"https://a.com"},
+				Methods: []string{"GET", "POST"},
+				Headers: []string{"Content-Type"},
+				MaxAge:  time.Duration(10) * time.Minute,
+			},
+			Origin:    "https://a.com",
+			Preflight: true,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":  "https://a.com",
+				"Access-Control-Allow-Methods": "GET,POST",
+				"Access-Control-Allow-Headers": "Content-Type",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			Cors:      Cors{Origins: []string{"https://a.com"}},
+			Origin:    "https://a.com",
+			Preflight: true,
+			Headers: map[string]string{
+				"Access-Control-Allow-Methods": "PUT",
+				"Access-Control-Allow-Headers": "X-Custom",
+			},
+		},
+	}
+	for i, c := range cs {
+		policy, err := newCorsPolicy(c.Cors)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+		req.Header.Set("Origin", c.Origin)
+		if c.Preflight {
+			req.Method = http.MethodOptions
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+			req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+		}
+		header := make(http.Header)
+		policy.inject(header, req, c.Preflight)
+		for k, v := range c.Headers {
+			assert.Equal(t, v, header.Get(k), "case %d, header: %s", i, k)
+		}
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	cs := []struct {
+		Global   bool
+		Method   string
+		URL      string
+		Origin   string
+		Request  string
+		Expected int
+		Headers  map[string]string
+	}{
+		{
+			Global:   true,
+			Method:   http.MethodOptions,
+			URL:      "/admin",
+			Origin:   "https://app.example.com",
+			Request:  "POST",
+			Expected: http.StatusNoContent,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET,POST",
+			},
+		},
+		{
+			Global:   true,
+			Method:   http.MethodOptions,
+			URL:      "/admin",
+			Origin:   "https://evil.com",
+			Request:  "POST",
+			Expected: http.StatusNoContent,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			Global:   true,
+			Method:   http.MethodOptions,
+			URL:      "/admin",
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Global:   true,
+			Method:   http.MethodGet,
+			URL:      "/admin",
+			Origin:   "https://app.example.com",
+			Expected: http.StatusUnauthorized,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Vary": "Origin"},
+		},
+		{
+			Global:   true,
+			Method:   http.MethodOptions,
+			URL:      "/partners",
+			Origin:   "https://partner.com",
+			Request:  "GET",
+			Expected: http.StatusNoContent,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://partner.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET",
+			},
+		},
+		{
+			Global:   true,
+			Method:   http.MethodOptions,
+			URL:      "/partners",
+			Origin:   "https://app.example.com",
+			Request:  "GET",
+			Expected: http.StatusNoContent,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			Method:   http.MethodOptions,
+			URL:      "/partners",
+			Origin:   "https://partner.com",
+			Request:  "GET",
+			Expected: http.StatusNoContent,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": "https://partner.com"},
+		},
+		{
+			Method:   http.MethodOptions,
+			URL:      "/admin",
+			Origin:   "https://app.example.com",
+			Request:  "POST",
+			Expected: http.StatusUnauthorized,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.NoRedirects = true
+		cfg.EnableCorsGlobal = c.Global
+		cfg.CorsOrigins = []string{"https://*.example.com"}
+		cfg.CorsMethods = []string{"GET", "POST"}
+		cfg.Resources = []*Resource{
+			{URL: "/admin", Methods: []string{"ANY"}},
+			{
+				URL:     "/partners",
+				Methods: []string{"ANY"},
+				Cors:    &Cors{Origins: []string{"https://partner.com"}, Methods: []string{"GET"}, Credentials: true},
+			},
+		}
+		_, _, svc := newTestProxyService(cfg)
+
+		req, _ := http.NewRequest(c.Method, svc+c.URL, nil)
+		if c.Origin != "" {
+			req.Header.Set("Origin", c.Origin)
+		}
+		if c.Request != "" {
+			req.Header.Set("Access-Control-Request-Method", c.Request)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d, %s %s", i, c.Method, c.URL)
+		for k, v := range c.Headers {
+			assert.Equal(t, v, resp.Header.Get(k), "case %d, header: %s", i, k)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// csrfMiddleware protects the state changing requests of cookie sessions from cross site request
+// forgery; the request is permitted when the Origin (or Referer) is one of the hosts of the proxy,
+// or the csrf token submitted in the header matches the one in the cookie (double submit)
+func (r *oauthProxy) csrfMiddleware() gin.HandlerFunc {
+	log.Info("enabling the csrf protection of the cookie sessions")
+
+	return func(cx *gin.Context) {
+		user, found := cx.Get(userContextName)
+		if !found || cx.IsAborted() {
+			return
+		}
+		// step: the bearer tokens are not sent automatically by the browser
+		if id := user.(*userContext); !id.isCookie() {
+			return
+		}
+
+		// step: ensure the session has a csrf token
+		token := ""
+		if cookie, err := cx.Request.Cookie(r.config.CSRFCookieName); err == nil {
+			token = cookie.Value
+		}
+		if token == "" {
+			value, err := newCSRFToken()
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to generate a csrf token")
+
+				cx.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			r.dropCSRFCookie(cx, value)
+		}
+
+		if isSafeMethod(cx.Request.Method) {
+			return
+		}
+		if resource, found := cx.Get(cxEnforce); found && resource.(*Resource).CSRFExempt {
+			return
+		}
+		if r.isPermittedOrigin(cx.Request) {
+			return
+		}
+		submitted := cx.Request.Header.Get(r.config.CSRFHeaderName)
+		if token != "" && subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) == 1 {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"access":  "denied",
+			"method":  cx.Request.Method,
+			"origin":  cx.Request.Header.Get("Origin"),
+			"referer": cx.Request.Referer(),
+			"uri":     cx.Request.URL.Path,
+		}).Warnf("access denied, the request failed the csrf protection")
+
+		r.accessForbidden(cx)
+	}
+}
+
+// isPermittedOrigin checks the Origin, or failing that the Referer, of the request is one of the
+// hosts of the proxy, i.e. the host requested or a redirection host
+func (r *oauthProxy) isPermittedOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Referer()
+	}
+	if origin == "" || origin == "null" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, resolveForwarded(req, r.trustedProxies).host) {
+		return true
+	}
+
+	return findRedirectionHost(r.redirectionHosts, u.Host) != nil
+}
+
+// newCSRFToken generates a random csrf token
+func newCSRFToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// isSafeMethod checks the method does not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
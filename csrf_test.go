@@ -0,0 +1,118 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCSRF = true
+	cfg.CSRFCookieName = "kc-csrf"
+	cfg.CSRFHeaderName = "X-CSRF-Token"
+	cfg.RedirectionHosts = []string{"https://app.example.com"}
+	cfg.Resources = []*Resource{
+		{URL: "/hooks", Methods: []string{"ANY"}, CSRFExempt: true},
+		{URL: "/api", Methods: []string{"ANY"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	signed, err := idp.signToken(newTestToken(idp.getLocation()).claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	host := strings.TrimPrefix(svc, "http://")
+
+	cs := []struct {
+		Method   string
+		URL      string
+		Bearer   bool
+		Token    string
+		Header   string
+		Origin   string
+		Referer  string
+		Expected int
+		Dropped  bool
+	}{
+		{Method: http.MethodGet, URL: "/api", Expected: http.StatusOK, Dropped: true},
+		{Method: http.MethodGet, URL: "/api", Token: "abc", Expected: http.StatusOK},
+		{Method: http.MethodPost, URL: "/api", Expected: http.StatusForbidden, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Token: "abc", Expected: http.StatusForbidden},
+		{Method: http.MethodPost, URL: "/api", Token: "abc", Header: "abd", Expected: http.StatusForbidden},
+		{Method: http.MethodPost, URL: "/api", Token: "abc", Header: "abc", Expected: http.StatusOK},
+		{Method: http.MethodDelete, URL: "/api", Header: "abc", Expected: http.StatusForbidden, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Origin: "https://evil.com", Expected: http.StatusForbidden, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Origin: "null", Expected: http.StatusForbidden, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Origin: "http://" + host, Expected: http.StatusOK, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Origin: "https://app.example.com", Expected: http.StatusOK, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Referer: "http://" + host + "/page", Expected: http.StatusOK, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Referer: "https://evil.com/page", Expected: http.StatusForbidden, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Origin: "https://evil.com", Token: "abc", Header: "abc", Expected: http.StatusOK},
+		{Method: http.MethodPost, URL: "/hooks", Expected: http.StatusOK, Dropped: true},
+		{Method: http.MethodPost, URL: "/api", Bearer: true, Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(c.Method, svc+c.URL, nil)
+		if c.Bearer {
+			req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		} else {
+			req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: signed.Encode()})
+		}
+		if c.Token != "" {
+			req.AddCookie(&http.Cookie{Name: cfg.CSRFCookieName, Value: c.Token})
+		}
+		if c.Header != "" {
+			req.Header.Set(cfg.CSRFHeaderName, c.Header)
+		}
+		if c.Origin != "" {
+			req.Header.Set("Origin", c.Origin)
+		}
+		if c.Referer != "" {
+			req.Header.Set("Referer", c.Referer)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d, %s %s", i, c.Method, c.URL)
+
+		var dropped *http.Cookie
+		for _, x := range resp.Cookies() {
+			if x.Name == cfg.CSRFCookieName {
+				dropped = x
+			}
+		}
+		if !assert.Equal(t, c.Dropped, dropped != nil, "case %d, the csrf cookie", i) || dropped == nil {
+			continue
+		}
+		assert.False(t, dropped.HttpOnly, "case %d, the csrf cookie should be readable by scripts", i)
+		assert.Len(t, dropped.Value, 43, "case %d", i)
+	}
+}
+
+func TestIsSafeMethod(t *testing.T) {
+	for _, x := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace} {
+		assert.True(t, isSafeMethod(x), "method: %s should be safe", x)
+	}
+	for _, x := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		assert.False(t, isSafeMethod(x), "method: %s should not be safe", x)
+	}
+}
@@ -41,22 +41,38 @@ const (
 	authorizationHeader = "Authorization"
 	versionHeader       = "X-Auth-Proxy-Version"
 	envPrefix           = "PROXY_"
+	silentCookieName    = "kc-silent"
+	stepUpCookieName    = "kc-step-up"
 
 	oauthURL         = "/oauth"
 	authorizationURL = "/authorize"
 	callbackURL      = "/callback"
 	healthURL        = "/health"
+	readyURL         = "/ready"
 	tokenURL         = "/token"
 	expiredURL       = "/expired"
 	logoutURL        = "/logout"
 	loginURL         = "/login"
 	metricsURL       = "/metrics"
+	notBeforeURL     = "/k_push_not_before"
+
+	matchAll = "all"
+	matchAny = "any"
 
 	claimPreferredName  = "preferred_username"
+	claimEmail          = "email"
+	claimGroups         = "groups"
 	claimAudience       = "aud"
 	claimResourceAccess = "resource_access"
 	claimRealmAccess    = "realm_access"
 	claimResourceRoles  = "roles"
+	claimIssuedAt       = "iat"
+	claimExpiration     = "exp"
+	claimNotBefore      = "nbf"
+	claimIssuer         = "iss"
+	claimAuthorizedBy   = "azp"
+	claimACR            = "acr"
+	claimAuthTime       = "auth_time"
 )
 
 var (
@@ -70,6 +86,10 @@ var (
 	ErrAccessTokenExpired = errors.New("the access token has expired")
 	// ErrRefreshTokenExpired indicates the refresh token as expired
 	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
+	// ErrAccessTokenNotValidYet indicates the access token is not yet valid
+	ErrAccessTokenNotValidYet = errors.New("the access token is not valid yet")
+	// ErrAccessTokenIssuedInFuture indicates the access token was issued in the future
+	ErrAccessTokenIssuedInFuture = errors.New("the access token was issued in the future")
 	// ErrNoTokenAudience indicates their is not audience in the token
 	ErrNoTokenAudience = errors.New("the token does not audience in claims")
 )
@@ -84,6 +104,48 @@ type Resource struct {
 	WhiteListed bool `json:"white-listed" yaml:"white-listed"`
 	// Roles the roles required to access this url
 	Roles []string `json:"roles" yaml:"roles"`
+	// Groups the groups required to access this url
+	Groups []string `json:"groups" yaml:"groups"`
+	// MethodRoles are the roles required for specific methods, in addition to the roles
+	MethodRoles map[string][]string `json:"method-roles" yaml:"method-roles"`
+	// AllowedCIDRs are the networks permitted to access the url, when empty all are permitted
+	AllowedCIDRs []string `json:"allowed-cidrs" yaml:"allowed-cidrs"`
+	// DeniedCIDRs are the networks denied access to the url
+	DeniedCIDRs []string `json:"denied-cidrs" yaml:"denied-cidrs"`
+	// ReportOnly logs and counts the would-be denials of the resource rather than enforcing them
+	ReportOnly bool `json:"report-only" yaml:"report-only"`
+	// Cors are the cors options of the url, in place of the global options
+	Cors *Cors `json:"cors" yaml:"cors"`
+	// CSRFExempt exempts the url from the csrf protection
+	CSRFExempt bool `json:"csrf-exempt" yaml:"csrf-exempt"`
+	// Deny denies the methods of the url to everyone, the deny resources are checked before the others
+	Deny bool `json:"deny" yaml:"deny"`
+	// Match is either all (default) or any, whether all or any of the roles and groups are required
+	Match string `json:"match" yaml:"match"`
+	// Expression is a boolean expression over the roles, groups and claims of the user
+	Expression string `json:"expression" yaml:"expression"`
+	// When is a rule of the embedded policy language over the request, claims and roles
+	When string `json:"when" yaml:"when"`
+	// Claims are the claims required to access this url, in addition to the global matches
+	Claims map[string]string `json:"claims" yaml:"claims"`
+	// Bindings binds the path parameters of the url to claims, the value of the parameter must be
+	// one of the values of the claim
+	Bindings map[string]string `json:"bindings" yaml:"bindings"`
+	// ACR is the authentication context class required to access this url
+	ACR string `json:"acr" yaml:"acr"`
+	// MaxAge is the maximum time since the user last authenticated
+	MaxAge time.Duration `json:"max-age" yaml:"max-age"`
+
+	// the parsed expression
+	expression expression
+	// the compiled when rule
+	rule *policyRule
+	// the parsed claim matchers
+	claimMatchers map[string]*claimMatcher
+	// the parsed networks
+	networks *networkPolicy
+	// the compiled cors options
+	cors *corsPolicy
 }
 
 // Cors access controls
@@ -112,12 +174,20 @@ type Config struct {
 	ListenHTTP string `json:"listen-http" yaml:"listen-http" usage:"interface we should be listening" env:"LISTEN_HTTP"`
 	// DiscoveryURL is the url for the keycloak server
 	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url" usage:"discovery url to retrieve the openid configuration" env:"DISCOVERY_URL"`
+	// PublicKeyFiles is a list of JWKS or PEM files holding the keys used to verify the tokens offline
+	PublicKeyFiles []string `json:"public-key-files" yaml:"public-key-files" usage:"a JWKS or PEM file holding the public keys used to verify tokens offline, permits running without a discovery url"`
+	// JWKSCacheFile is the file the provider keys are persisted to and loaded from at startup
+	JWKSCacheFile string `json:"jwks-cache-file" yaml:"jwks-cache-file" usage:"persist the provider keys to this file, loaded on startup in case the provider is unavailable"`
+	// TokenIssuer is the expected issuer of the tokens when verifying offline
+	TokenIssuer string `json:"token-issuer" yaml:"token-issuer" usage:"the expected issuer of the tokens when verifying with the public key files"`
 	// ClientID is the client id
 	ClientID string `json:"client-id" yaml:"client-id" usage:"client id used to authenticate to the oauth service" env:"CLIENT_ID"`
 	// ClientSecret is the secret for AS
 	ClientSecret string `json:"client-secret" yaml:"client-secret" usage:"client secret used to authenticate to the oauth service" env:"CLIENT_SECRET"`
 	// RedirectionURL the redirection url
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url" usage:"redirection url for the oauth callback url, defaults to host header is absent" env:"REDIRECTION_URL"`
+	// RedirectionHosts are the external hosts the redirection url may be derived from
+	RedirectionHosts []string `json:"redirection-hosts" yaml:"redirection-hosts" usage:"the external hosts the redirection url may be derived from when no redirection url is set, with an optional scheme i.e. https://app.example.com"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url" usage:"url for the revocation endpoint to revoke refresh token" env:"REVOCATION_URL"`
 	// SkipOpenIDProviderTLSVerify skips the tls verification for openid provider communication
@@ -131,6 +201,12 @@ type Config struct {
 	// Headers permits adding customs headers across the board
 	Headers map[string]string `json:"headers" yaml:"headers" usage:"custom headers to the upstream request, key=value"`
 
+	// EnableCSRF enables the csrf protection of the state changing requests of cookie sessions
+	EnableCSRF bool `json:"enable-csrf" yaml:"enable-csrf" usage:"protect the state changing requests of cookie sessions from cross site request forgery"`
+	// CSRFCookieName is the name of the cookie holding the csrf token
+	CSRFCookieName string `json:"csrf-cookie-name" yaml:"csrf-cookie-name" usage:"name of the cookie holding the csrf token"`
+	// CSRFHeaderName is the name of the header the csrf token is submitted in
+	CSRFHeaderName string `json:"csrf-header-name" yaml:"csrf-header-name" usage:"name of the header the csrf token is submitted in"`
 	// EnableCorsGlobal enables the CORs header in all response headers
 	EnableCorsGlobal bool `json:"enable-cors-global" yaml:"enable-cors-global" usage:"inject the CORs headers into all responses" env:"ENABLE_CORS_GLOBAL"`
 	// EnableForwarding enables the forwarding proxy
@@ -139,8 +215,12 @@ type Config struct {
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter" usage:"enables the security filter handler"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens" usage:"nables the handling of the refresh tokens" env:"ENABLE_SECURITY_FILTER"`
+	// EnableSilentAuthentication indicates we attempt a prompt=none authorization before an interactive login
+	EnableSilentAuthentication bool `json:"enable-silent-authentication" yaml:"enable-silent-authentication" usage:"attempt a silent prompt=none authorization, falling back to an interactive login if the sso session has gone"`
 	// EnableLoginHandler indicates we want the login handler enabled
 	EnableLoginHandler bool `json:"enable-login-handler" yaml:"enable-login-handler" usage:"enables the handling of the refresh tokens" env:"ENABLE_LOGIN_HANDLER"`
+	// ScrubHeaders are additional headers removed from the inbound requests, the X-Auth-* headers are always removed
+	ScrubHeaders []string `json:"scrub-headers" yaml:"scrub-headers" usage:"additional headers removed from the inbound requests before being proxied, the X-Auth-* headers are always removed"`
 	// EnableAuthorizationHeader indicates we should pass the authorization header
 	EnableAuthorizationHeader bool `json:"enable-authorization-header" yaml:"enable-authorization-header" usage:"adds the authorization header to the proxy request"`
 	// EnableHTTPSRedirect indicate we should redirection http -> https
@@ -157,9 +237,15 @@ type Config struct {
 	EnableFrameDeny bool `json:"filter-frame-deny" yaml:"filter-frame-deny" usage:"enable to the frame deny header"`
 	// ContentSecurityPolicy allows the Content-Security-Policy header value to be set with a custom value
 	ContentSecurityPolicy string `json:"content-security-policy" yaml:"content-security-policy" usage:"specify the content security policy"`
+	// EnableNotBeforePush indicates we accept not-before policies pushed from the keycloak admin
+	EnableNotBeforePush bool `json:"enable-not-before-push" yaml:"enable-not-before-push" usage:"enables the keycloak push not-before handler, the client admin url should be set to <site>/oauth"`
 	// LocalhostMetrics indicated the metrics can only be consume via localhost
 	LocalhostMetrics bool `json:"localhost-metrics" yaml:"localhost-metrics" usage:"enforces the metrics page can only been requested from 127.0.0.1"`
 
+	// RefreshWindow is the window before expiry in which the access token is proactively refreshed
+	RefreshWindow string `json:"refresh-window" yaml:"refresh-window" usage:"refresh the access token when within the window of expiry, either a duration i.e. 30s or a percentage of the token lifetime i.e. 20%"`
+	// ClockSkew is the leeway allowed on the time claims of the tokens
+	ClockSkew time.Duration `json:"clock-skew" yaml:"clock-skew" usage:"the leeway allowed on the exp, nbf and iat claims of the tokens to cater for clock drift"`
 	// AccessTokenDuration is default duration applied to the access token cookie
 	AccessTokenDuration time.Duration `json:"access-token-duration" yaml:"access-token-duration" usage:"fallback cookie duration for the access token when using refresh tokens"`
 	// CookieDomain is a list of domains the cookie is available to
@@ -173,10 +259,37 @@ type Config struct {
 	// HTTPOnlyCookie enforces the cookie as http only
 	HTTPOnlyCookie bool `json:"http-only-cookie" yaml:"http-only-cookie" usage:"enforces the cookie is in http only mode"`
 
+	// AuthorizerURL is the url of the external policy endpoint, i.e. open policy agent
+	AuthorizerURL string `json:"authorizer-url" yaml:"authorizer-url" usage:"the url of an external policy endpoint (open policy agent compatible) consulted for the protected resources"`
+	// AuthorizerTimeout is the timeout on requests to the policy endpoint
+	AuthorizerTimeout time.Duration `json:"authorizer-timeout" yaml:"authorizer-timeout" usage:"the timeout on requests to the external policy endpoint"`
+	// AuthorizerCacheKey are the elements making up the key the decisions are cached by
+	AuthorizerCacheKey []string `json:"authorizer-cache-key" yaml:"authorizer-cache-key" usage:"the elements of the key the decisions are cached by, method, path, resource, subject, roles, groups, header:NAME or claim:NAME"`
+	// AuthorizerCacheTTL is the duration the decisions are cached for
+	AuthorizerCacheTTL time.Duration `json:"authorizer-cache-ttl" yaml:"authorizer-cache-ttl" usage:"the duration the decisions of the external policy endpoint are cached for"`
+
+	// AllowedCIDRs are the networks permitted to access the proxy, when empty all are permitted
+	AllowedCIDRs []string `json:"allowed-cidrs" yaml:"allowed-cidrs" usage:"the networks (cidrs or addresses) permitted to access the proxy, defaults to all"`
+	// DeniedCIDRs are the networks denied access to the proxy
+	DeniedCIDRs []string `json:"denied-cidrs" yaml:"denied-cidrs" usage:"the networks (cidrs or addresses) denied access to the proxy, checked before the allowed"`
+	// TrustedProxies are the networks of the proxies whose forwarded headers are honored
+	TrustedProxies []string `json:"trusted-proxies" yaml:"trusted-proxies" usage:"the networks of the proxies trusted to set the forwarded headers (Forwarded and X-Forwarded-*) of the client"`
+
+	// ReportOnly logs and counts the denials of the protected resources rather than enforcing them
+	ReportOnly bool `json:"report-only" yaml:"report-only" usage:"log and count the requests which would be denied by the resources, rather than denying them"`
+
 	// MatchClaims is a series of checks, the claims in the token must match those here
 	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims" usage:"keypair values for matching access token claims e.g. aud=myapp, iss=http://example.*"`
 	// AddClaims is a series of claims that should be added to the auth headers
 	AddClaims []string `json:"add-claims" yaml:"add-claims" usage:"extra claims from the token and inject into headers, e.g given_name -> X-Auth-Given-Name"`
+	// UsernameClaim is the path of the claim holding the username
+	UsernameClaim string `json:"username-claim" yaml:"username-claim" usage:"the claim holding the username, dot notation for nested claims, defaults to preferred_username"`
+	// EmailClaim is the path of the claim holding the email
+	EmailClaim string `json:"email-claim" yaml:"email-claim" usage:"the claim holding the email, dot notation for nested claims, defaults to email"`
+	// GroupsClaim is the path of the claim holding the groups
+	GroupsClaim string `json:"groups-claim" yaml:"groups-claim" usage:"the claim holding the groups of the user, dot notation for nested claims, defaults to groups"`
+	// RoleClaims are the paths of the claims holding the roles of the user
+	RoleClaims []string `json:"role-claims" yaml:"role-claims" usage:"the claims holding the roles in the form PATH[=PREFIX], dot notation for nested claims with * matching any key, defaults to the keycloak realm and client roles"`
 
 	// TLSCertificate is the location for a tls certificate
 	TLSCertificate string `json:"tls-cert" yaml:"tls-cert" usage:"path to ths TLS certificate"`
@@ -192,7 +305,7 @@ type Config struct {
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify" usage:"skip the verification of any upstream TLS"`
 
 	// CorsOrigins is a list of origins permitted
-	CorsOrigins []string `json:"cors-origins" yaml:"cors-origins" usage:"origins to add to the CORE origins control (Access-Control-Allow-Origin)"`
+	CorsOrigins []string `json:"cors-origins" yaml:"cors-origins" usage:"origins permitted by the CORS origins control (Access-Control-Allow-Origin), i.e. https://app.example.com, https://*.example.com or * for any"`
 	// CorsMethods is a set of access control methods
 	CorsMethods []string `json:"cors-methods" yaml:"cors-methods" usage:"methods permitted in the access control (Access-Control-Allow-Methods)"`
 	// CorsHeaders is a set of cors headers
@@ -276,8 +389,18 @@ type userContext struct {
 	preferredName string
 	// the expiration of the access token
 	expiresAt time.Time
+	// the time the access token was issued
+	issuedAt time.Time
+	// the issuer of the access token
+	issuer string
+	// the authentication context class of the session
+	acr string
+	// the time the user authenticated
+	authTime time.Time
 	// a set of roles associated
 	roles []string
+	// the groups the user is a member of
+	groups []string
 	// the audience for the token
 	audience string
 	// the access token itself
@@ -288,6 +411,15 @@ type userContext struct {
 	bearerToken bool
 }
 
+// notBeforeAction is the admin action sent by keycloak when pushing a not-before policy
+type notBeforeAction struct {
+	ID         string `json:"id"`
+	Action     string `json:"action"`
+	Resource   string `json:"resource"`
+	Expiration int64  `json:"expiration"`
+	NotBefore  int64  `json:"notBefore"`
+}
+
 // tokenResponse
 type tokenResponse struct {
 	TokenType    string `json:"token_type"`
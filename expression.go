@@ -0,0 +1,247 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// expression is a boolean expression evaluated against the identity of the user
+type expression interface {
+	// evaluate returns the result of the expression for the user
+	evaluate(*userContext) bool
+}
+
+// andExpression is satisfied when both sides are satisfied
+type andExpression struct {
+	left, right expression
+}
+
+func (e andExpression) evaluate(user *userContext) bool {
+	return e.left.evaluate(user) && e.right.evaluate(user)
+}
+
+// orExpression is satisfied when either side is satisfied
+type orExpression struct {
+	left, right expression
+}
+
+func (e orExpression) evaluate(user *userContext) bool {
+	return e.left.evaluate(user) || e.right.evaluate(user)
+}
+
+// notExpression negates the expression
+type notExpression struct {
+	expr expression
+}
+
+func (e notExpression) evaluate(user *userContext) bool {
+	return !e.expr.evaluate(user)
+}
+
+// termExpression checks a role, group or claim of the user
+type termExpression struct {
+	// the kind of term, role, group or claim
+	kind string
+	// the name of the role, group or claim
+	name string
+	// the value required of the claim, if any
+	value string
+	// indicates a value is required
+	hasValue bool
+}
+
+func (e termExpression) evaluate(user *userContext) bool {
+	switch e.kind {
+	case "role":
+		return containedIn(e.name, user.roles)
+	case "group":
+		return isGroupMember(e.name, user.groups)
+	default:
+		values := getClaimValues(user.claims, e.name)
+		if !e.hasValue {
+			return len(values) > 0
+		}
+		return containedIn(e.value, values)
+	}
+}
+
+// parseExpression parses a boolean expression of role:NAME, group:NAME and claim:NAME[=VALUE]
+// terms, combined with and / or / not (or &&, ||, !) and parentheses
+func parseExpression(value string) (expression, error) {
+	tokens, err := tokenizeExpression(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) <= 0 {
+		return nil, errors.New("the expression is empty")
+	}
+	parser := &expressionParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token, found := parser.peek(); found {
+		return nil, fmt.Errorf("unexpected token: '%s' in expression", token)
+	}
+
+	return expr, nil
+}
+
+// tokenizeExpression splits the expression into operators, parentheses and terms
+func tokenizeExpression(value string) ([]string, error) {
+	var tokens []string
+	runes := []rune(value)
+	for i := 0; i < len(runes); {
+		switch c := runes[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(runes) || runes[i+1] != c {
+				return nil, fmt.Errorf("invalid operator: '%c' in expression, did you mean '%c%c'", c, c, c)
+			}
+			tokens = append(tokens, string([]rune{c, c}))
+			i += 2
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()&|", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		}
+	}
+
+	return tokens, nil
+}
+
+// expressionParser is a recursive descent parser over the tokens of an expression
+type expressionParser struct {
+	tokens   []string
+	position int
+}
+
+func (p *expressionParser) peek() (string, bool) {
+	if p.position >= len(p.tokens) {
+		return "", false
+	}
+
+	return p.tokens[p.position], true
+}
+
+func (p *expressionParser) next() (string, bool) {
+	token, found := p.peek()
+	if found {
+		p.position++
+	}
+
+	return token, found
+}
+
+// parseOr parses: and { (or | ||) and }
+func (p *expressionParser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token, _ := p.peek()
+		if token != "||" && strings.ToLower(token) != "or" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpression{left: left, right: right}
+	}
+}
+
+// parseAnd parses: unary { (and | &&) unary }
+func (p *expressionParser) parseAnd() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token, _ := p.peek()
+		if token != "&&" && strings.ToLower(token) != "and" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpression{left: left, right: right}
+	}
+}
+
+// parseUnary parses: (not | !) unary | ( or ) | term
+func (p *expressionParser) parseUnary() (expression, error) {
+	token, found := p.next()
+	if !found {
+		return nil, errors.New("unexpected end of expression")
+	}
+	switch {
+	case token == "!" || strings.ToLower(token) == "not":
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpression{expr: expr}, nil
+	case token == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, _ := p.next(); closing != ")" {
+			return nil, errors.New("missing closing parenthesis in expression")
+		}
+		return expr, nil
+	}
+
+	return parseExpressionTerm(token)
+}
+
+// parseExpressionTerm parses a role:NAME, group:NAME or claim:NAME[=VALUE] term
+func parseExpressionTerm(token string) (expression, error) {
+	items := strings.SplitN(token, ":", 2)
+	if len(items) != 2 || items[1] == "" {
+		return nil, fmt.Errorf("invalid term: '%s' in expression, should be role:NAME, group:NAME or claim:NAME[=VALUE]", token)
+	}
+	term := termExpression{kind: strings.ToLower(items[0]), name: items[1]}
+	switch term.kind {
+	case "role", "group":
+	case "claim":
+		if kv := strings.SplitN(items[1], "=", 2); len(kv) == 2 {
+			term.name, term.value, term.hasValue = kv[0], kv[1], true
+		}
+		if term.name == "" {
+			return nil, fmt.Errorf("invalid term: '%s' in expression, the claim has no name", token)
+		}
+	default:
+		return nil, fmt.Errorf("invalid term: '%s' in expression, should be role:NAME, group:NAME or claim:NAME[=VALUE]", token)
+	}
+
+	return term, nil
+}
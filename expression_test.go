@@ -0,0 +1,101 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpression(t *testing.T) {
+	cs := []struct {
+		Expression string
+		Ok         bool
+	}{
+		{Expression: "role:admin", Ok: true},
+		{Expression: "role:admin or role:auditor", Ok: true},
+		{Expression: "role:admin || role:auditor", Ok: true},
+		{Expression: "role:admin&&group:/org/dev", Ok: true},
+		{Expression: "(role:admin or role:auditor) and not group:/contractors", Ok: true},
+		{Expression: "!(claim:email_verified=false)", Ok: true},
+		{Expression: "claim:tenant", Ok: true},
+		{Expression: "ROLE:admin AND NOT role:guest", Ok: true},
+		{Expression: ""},
+		{Expression: "admin"},
+		{Expression: "role:"},
+		{Expression: "user:admin"},
+		{Expression: "claim:=value"},
+		{Expression: "role:admin or"},
+		{Expression: "role:admin role:auditor"},
+		{Expression: "(role:admin"},
+		{Expression: "role:admin)"},
+		{Expression: "role:admin & role:auditor"},
+		{Expression: "role:admin | role:auditor"},
+	}
+	for i, c := range cs {
+		_, err := parseExpression(c.Expression)
+		if c.Ok {
+			assert.NoError(t, err, "case %d, expression: %s should not have failed", i, c.Expression)
+			continue
+		}
+		assert.Error(t, err, "case %d, expression: %s should have failed", i, c.Expression)
+	}
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	user := &userContext{
+		roles:  []string{"auditor", "app:viewer"},
+		groups: []string{"/org/dev/backend"},
+		claims: jose.Claims{
+			"email_verified": true,
+			"tenant":         "acme",
+			"scopes":         []interface{}{"read", "write"},
+		},
+	}
+	cs := []struct {
+		Expression string
+		Expected   bool
+	}{
+		{Expression: "role:auditor", Expected: true},
+		{Expression: "role:admin"},
+		{Expression: "role:admin or role:auditor", Expected: true},
+		{Expression: "role:admin and role:auditor"},
+		{Expression: "role:app:viewer", Expected: true},
+		{Expression: "group:/org/dev", Expected: true},
+		{Expression: "group:/org/ops"},
+		{Expression: "not group:/org/ops", Expected: true},
+		{Expression: "!role:auditor"},
+		{Expression: "claim:tenant=acme", Expected: true},
+		{Expression: "claim:tenant=other"},
+		{Expression: "claim:tenant", Expected: true},
+		{Expression: "claim:missing"},
+		{Expression: "claim:email_verified=true", Expected: true},
+		{Expression: "claim:scopes=write", Expected: true},
+		{Expression: "role:admin or role:auditor and group:/org/ops"},
+		{Expression: "role:auditor or role:admin and group:/org/ops", Expected: true},
+		{Expression: "(role:auditor or role:admin) and group:/org/ops"},
+		{Expression: "(role:admin || role:auditor) && !claim:tenant=other", Expected: true},
+	}
+	for i, c := range cs {
+		expr, err := parseExpression(c.Expression)
+		if !assert.NoError(t, err, "case %d, expression: %s", i, c.Expression) {
+			continue
+		}
+		assert.Equal(t, c.Expected, expr.evaluate(user), "case %d, expression: %s", i, c.Expression)
+	}
+}
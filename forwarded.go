@@ -0,0 +1,380 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	headerForwarded      = "Forwarded"
+	headerForwardedFor   = "X-Forwarded-For"
+	headerForwardedHost  = "X-Forwarded-Host"
+	headerForwardedProto = "X-Forwarded-Proto"
+)
+
+// forwardedHop is an element of the Forwarded header (rfc 7239), or the equivalent taken from the
+// X-Forwarded-* headers, describing a single hop of the request
+type forwardedHop struct {
+	// the address of the node making the request to the proxy, nil when unknown or obfuscated
+	node net.IP
+	// the interface the request came in on
+	by string
+	// the host requested
+	host string
+	// the protocol requested
+	proto string
+}
+
+// forwardedRequest is the origin of the request, as seen through the trusted proxies
+type forwardedRequest struct {
+	// the address of the client
+	clientIP net.IP
+	// the host requested by the client
+	host string
+	// the protocol requested by the client
+	proto string
+	// the hops taken through the trusted proxies, starting with the client
+	chain []forwardedHop
+}
+
+// resolveForwarded returns the origin of the request; the forwarded headers are only honored when
+// the request came from a trusted proxy, walking the hops from the right until the first address
+// which is not a trusted proxy. The Forwarded header takes precedence over the X-Forwarded-* ones.
+// When the headers of a trusted proxy cannot be parsed, or the hop is an unknown node, the client
+// address is nil; failing closed rather than resolving the client as the trusted proxy
+func resolveForwarded(req *http.Request, trusted []*net.IPNet) *forwardedRequest {
+	remote := getRemoteIP(req)
+	result := &forwardedRequest{
+		clientIP: remote,
+		host:     req.Host,
+		proto:    getRequestScheme(req),
+	}
+	if remote == nil || !containsIP(trusted, remote) {
+		return result
+	}
+
+	hops, err := getForwardedHops(req)
+	if err != nil {
+		result.clientIP = nil
+		result.chain = []forwardedHop{{}}
+		return result
+	}
+	start := len(hops)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		start = i
+		result.clientIP = hop.node
+		if hop.node == nil {
+			break
+		}
+		if hop.host != "" && isValidForwardedHost(hop.host) {
+			result.host = hop.host
+		}
+		if proto := strings.ToLower(hop.proto); proto == "http" || proto == "https" {
+			result.proto = proto
+		}
+		if !containsIP(trusted, hop.node) {
+			break
+		}
+	}
+	result.chain = hops[start:]
+
+	return result
+}
+
+// setForwardedHeaders sets the X-Forwarded-* and Forwarded headers for the upstream, the hops of
+// untrusted proxies are discarded and the hop of the proxy appended
+func setForwardedHeaders(req *http.Request, trusted []*net.IPNet) {
+	forwarded := resolveForwarded(req, trusted)
+	remote := getRemoteIP(req)
+
+	var addresses, elements []string
+	for _, hop := range append(forwarded.chain, forwardedHop{node: remote, host: req.Host, proto: getRequestScheme(req)}) {
+		node := "unknown"
+		if hop.node != nil {
+			node = hop.node.String()
+		}
+		addresses = append(addresses, node)
+		elements = append(elements, hop.String())
+	}
+
+	req.Header.Set(headerForwardedFor, strings.Join(addresses, ", "))
+	req.Header.Set(headerForwardedHost, forwarded.host)
+	req.Header.Set(headerForwardedProto, forwarded.proto)
+	req.Header.Set(headerForwarded, strings.Join(elements, ", "))
+}
+
+// getForwardedHops returns the hops from the Forwarded header, or failing that the X-Forwarded-*
+// headers, where the protocols and hosts are aligned with the addresses from the right
+func getForwardedHops(req *http.Request) ([]forwardedHop, error) {
+	if values := req.Header[headerForwarded]; len(values) > 0 {
+		return parseForwarded(values)
+	}
+
+	addresses := splitHeaderList(req.Header[headerForwardedFor])
+	protos := splitHeaderList(req.Header[headerForwardedProto])
+	hosts := splitHeaderList(req.Header[headerForwardedHost])
+	hops := make([]forwardedHop, len(addresses))
+	for i, x := range addresses {
+		hops[i].node = parseForwardedNode(x)
+		if j := len(protos) - len(addresses) + i; j >= 0 && j < len(protos) {
+			hops[i].proto = protos[j]
+		}
+		if j := len(hosts) - len(addresses) + i; j >= 0 && j < len(hosts) {
+			hops[i].host = hosts[j]
+		}
+	}
+
+	return hops, nil
+}
+
+// parseForwarded parses the values of the Forwarded header, i.e.
+// for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(values []string) ([]forwardedHop, error) {
+	var hops []forwardedHop
+	for _, value := range values {
+		elements, err := splitQuoted(value, ',')
+		if err != nil {
+			return nil, err
+		}
+		for _, element := range elements {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+			pairs, err := splitQuoted(element, ';')
+			if err != nil {
+				return nil, err
+			}
+			var hop forwardedHop
+			for _, pair := range pairs {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return nil, fmt.Errorf("invalid forwarded pair: %s", pair)
+				}
+				v, err := unquoteForwarded(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					hop.node = parseForwardedNode(v)
+				case "by":
+					hop.by = v
+				case "host":
+					hop.host = v
+				case "proto":
+					hop.proto = v
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops, nil
+}
+
+// parseForwardedNode parses the address of a node, i.e. 192.0.2.43, 192.0.2.43:47011 or
+// [2001:db8::1]:4711, returning nil for unknown or obfuscated nodes
+func parseForwardedNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(node[1:end])
+	}
+	if strings.Count(node, ":") == 1 {
+		node = node[:strings.Index(node, ":")]
+	}
+
+	return net.ParseIP(node)
+}
+
+// String returns the hop as an element of the Forwarded header
+func (h forwardedHop) String() string {
+	node := "unknown"
+	if h.node != nil {
+		node = h.node.String()
+		if h.node.To4() == nil {
+			node = fmt.Sprintf("[%s]", node)
+		}
+	}
+	pairs := []string{"for=" + quoteForwarded(node)}
+	if h.by != "" {
+		pairs = append(pairs, "by="+quoteForwarded(h.by))
+	}
+	if h.host != "" {
+		pairs = append(pairs, "host="+quoteForwarded(h.host))
+	}
+	if h.proto != "" {
+		pairs = append(pairs, "proto="+quoteForwarded(h.proto))
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// splitQuoted splits the value by the separator, ignoring those within quoted strings
+func splitQuoted(value string, separator rune) ([]string, error) {
+	var list []string
+	var quoted, escaped bool
+	start := 0
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == separator:
+			list = append(list, value[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string in the forwarded header")
+	}
+
+	return append(list, value[start:]), nil
+}
+
+// unquoteForwarded removes the quotes and escapes of a quoted string
+func unquoteForwarded(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+		return "", fmt.Errorf("invalid quoted string: %s", value)
+	}
+	var unquoted []rune
+	escaped := false
+	for _, c := range value[1 : len(value)-1] {
+		if !escaped && c == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		unquoted = append(unquoted, c)
+	}
+
+	return string(unquoted), nil
+}
+
+// quoteForwarded quotes the value if it isn't a token
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+	}
+
+	return value
+}
+
+// isTokenChar checks if the character is permitted in a token (rfc 7230)
+func isTokenChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// redirectionHost is an external host the redirection url may be derived from
+type redirectionHost struct {
+	// the scheme of the host, when empty the scheme requested is used
+	scheme string
+	// the host and optional port
+	host string
+}
+
+// parseRedirectionHost parses a host with an optional scheme, i.e. https://app.example.com
+func parseRedirectionHost(value string) (*redirectionHost, error) {
+	host := &redirectionHost{host: value}
+	if strings.Contains(value, "://") {
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirection host: %s, error: %s", value, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid redirection host: %s, the scheme must be http or https", value)
+		}
+		if strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid redirection host: %s, should be a scheme and host only", value)
+		}
+		host.scheme, host.host = u.Scheme, u.Host
+	}
+	if host.host == "" || !isValidForwardedHost(host.host) {
+		return nil, fmt.Errorf("invalid redirection host: %s", value)
+	}
+	host.host = strings.ToLower(host.host)
+
+	return host, nil
+}
+
+// findRedirectionHost returns the redirection host matching the requested host
+func findRedirectionHost(hosts []*redirectionHost, host string) *redirectionHost {
+	host = strings.ToLower(host)
+	for _, x := range hosts {
+		if x.host == host {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// isValidForwardedHost checks the forwarded host is a host and optional port
+func isValidForwardedHost(host string) bool {
+	return !strings.ContainsAny(host, "/\\@?# \t\"")
+}
+
+// splitHeaderList splits the comma separated values of the header
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, x := range strings.Split(value, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				list = append(list, x)
+			}
+		}
+	}
+
+	return list
+}
+
+// getRemoteIP returns the address of the peer making the request
+func getRemoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// getRequestScheme returns the scheme the request was received on
+func getRequestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwarded(t *testing.T) {
+	cs := []struct {
+		Values   []string
+		Expected []forwardedHop
+		Ok       bool
+	}{
+		{
+			Values:   []string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			Expected: []forwardedHop{{node: net.ParseIP("192.0.2.60"), proto: "http", by: "203.0.113.43"}},
+			Ok:       true,
+		},
+		{
+			Values: []string{`For="[2001:db8:cafe::17]:4711", for=192.0.2.43:47011;Host="example.com:8443"`},
+			Expected: []forwardedHop{
+				{node: net.ParseIP("2001:db8:cafe::17")},
+				{node: net.ParseIP("192.0.2.43"), host: "example.com:8443"},
+			},
+			Ok: true,
+		},
+		{
+			Values:   []string{"for=unknown", "for=_hidden;proto=https"},
+			Expected: []forwardedHop{{}, {proto: "https"}},
+			Ok:       true,
+		},
+		{
+			Values:   []string{`for="10.0.0.1";host="a\"b"`},
+			Expected: []forwardedHop{{node: net.ParseIP("10.0.0.1"), host: `a"b`}},
+			Ok:       true,
+		},
+		{Values: []string{`for="10.0.0.1`}},
+		{Values: []string{"for"}},
+		{Values: []string{"=10.0.0.1"}},
+	}
+	for i, c := range cs {
+		hops, err := parseForwarded(c.Values)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, len(c.Expected), len(hops), "case %d", i)
+			for j := 0; j < len(hops) && j < len(c.Expected); j++ {
+				assert.Equal(t, c.Expected[j].node.String(), hops[j].node.String(), "case %d, hop %d", i, j)
+				assert.Equal(t, c.Expected[j].host, hops[j].host, "case %d, hop %d", i, j)
+				assert.Equal(t, c.Expected[j].proto, hops[j].proto, "case %d, hop %d", i, j)
+				assert.Equal(t, c.Expected[j].by, hops[j].by, "case %d, hop %d", i, j)
+			}
+		}
+	}
+}
+
+func TestForwardedHopString(t *testing.T) {
+	cs := []struct {
+		Hop      forwardedHop
+		Expected string
+	}{
+		{Hop: forwardedHop{}, Expected: "for=unknown"},
+		{Hop: forwardedHop{node: net.ParseIP("192.0.2.60"), proto: "https"}, Expected: "for=192.0.2.60;proto=https"},
+		{Hop: forwardedHop{node: net.ParseIP("2001:db8::1")}, Expected: `for="[2001:db8::1]"`},
+		{Hop: forwardedHop{node: net.ParseIP("10.0.0.1"), host: "example.com:8080"}, Expected: `for=10.0.0.1;host="example.com:8080"`},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, c.Hop.String(), "case %d", i)
+	}
+}
+
+func TestResolveForwarded(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	cs := []struct {
+		RemoteAddr string
+		Headers    map[string]string
+		TLS        bool
+		ClientIP   string
+		Host       string
+		Proto      string
+		Chain      int
+	}{
+		{
+			RemoteAddr: "192.168.1.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Host": "evil.com", "X-Forwarded-Proto": "https"},
+			ClientIP:   "192.168.1.1",
+			Host:       "proxy.local",
+			Proto:      "http",
+		},
+		{
+			RemoteAddr: "192.168.1.1:1000",
+			Headers:    map[string]string{"Forwarded": "for=1.1.1.1;host=evil.com;proto=http"},
+			TLS:        true,
+			ClientIP:   "192.168.1.1",
+			Host:       "proxy.local",
+			Proto:      "https",
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Host": "example.com", "X-Forwarded-Proto": "https"},
+			ClientIP:   "1.1.1.1",
+			Host:       "example.com",
+			Proto:      "https",
+			Chain:      1,
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.1.1.1, 10.0.0.2", "X-Forwarded-Proto": "https"},
+			ClientIP:   "1.1.1.1",
+			Host:       "proxy.local",
+			Proto:      "https",
+			Chain:      2,
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers: map[string]string{
+				"Forwarded":       `for=6.6.6.6;host=evil.com, for="1.1.1.1:4000";host=example.com;proto=https, for=10.0.0.2`,
+				"X-Forwarded-For": "9.9.9.9",
+			},
+			ClientIP: "1.1.1.1",
+			Host:     "example.com",
+			Proto:    "https",
+			Chain:    2,
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"Forwarded": "for=unknown;host=evil.com, for=10.0.0.2;proto=https"},
+			ClientIP:   "<nil>",
+			Host:       "proxy.local",
+			Proto:      "https",
+			Chain:      2,
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"Forwarded": `for="1.1.1.1`},
+			ClientIP:   "<nil>",
+			Host:       "proxy.local",
+			Proto:      "http",
+			Chain:      1,
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, not-an-address"},
+			ClientIP:   "<nil>",
+			Host:       "proxy.local",
+			Proto:      "http",
+			Chain:      1,
+		},
+		{
+			RemoteAddr: "192.168.1.1:1000",
+			Headers:    map[string]string{"Forwarded": `for="1.1.1.1`},
+			ClientIP:   "192.168.1.1",
+			Host:       "proxy.local",
+			Proto:      "http",
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Host": "evil.com/path", "X-Forwarded-Proto": "javascript"},
+			ClientIP:   "1.1.1.1",
+			Host:       "proxy.local",
+			Proto:      "http",
+			Chain:      1,
+		},
+	}
+	for i, c := range cs {
+		req := &http.Request{RemoteAddr: c.RemoteAddr, Host: "proxy.local", Header: make(http.Header)}
+		if c.TLS {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		forwarded := resolveForwarded(req, trusted)
+		assert.Equal(t, c.ClientIP, forwarded.clientIP.String(), "case %d", i)
+		assert.Equal(t, c.Host, forwarded.host, "case %d", i)
+		assert.Equal(t, c.Proto, forwarded.proto, "case %d", i)
+		assert.Equal(t, c.Chain, len(forwarded.chain), "case %d", i)
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	cs := []struct {
+		RemoteAddr string
+		Headers    map[string]string
+		Expected   map[string]string
+	}{
+		{
+			RemoteAddr: "192.168.1.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https", "Forwarded": "for=1.1.1.1"},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "192.168.1.1",
+				"X-Forwarded-Host":  "proxy.local",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=192.168.1.1;host=proxy.local;proto=http",
+			},
+		},
+		{
+			RemoteAddr: "10.0.0.1:1000",
+			Headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.1.1.1", "X-Forwarded-Host": "example.com", "X-Forwarded-Proto": "https"},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1, 10.0.0.1",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.1.1.1;host=example.com;proto=https, for=10.0.0.1;host=proxy.local;proto=http",
+			},
+		},
+		{
+			RemoteAddr: "[::1]:1000",
+			Expected: map[string]string{
+				"X-Forwarded-For": "::1",
+				"Forwarded":       `for="[::1]";host=proxy.local;proto=http`,
+			},
+		},
+	}
+	for i, c := range cs {
+		req := &http.Request{RemoteAddr: c.RemoteAddr, Host: "proxy.local", Header: make(http.Header)}
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		setForwardedHeaders(req, trusted)
+		for k, v := range c.Expected {
+			assert.Equal(t, v, req.Header.Get(k), "case %d, header: %s", i, k)
+		}
+	}
+}
+
+func TestForwardedHeadersUpstream(t *testing.T) {
+	cs := []struct {
+		TrustedProxies []string
+		Headers        map[string]string
+		Expected       map[string]string
+	}{
+		{
+			Headers: map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https"},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "127.0.0.1",
+				"X-Forwarded-Proto": "http",
+			},
+		},
+		{
+			TrustedProxies: []string{"127.0.0.1"},
+			Headers:        map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com"},
+			Expected: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1, 127.0.0.1",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Proto": "https",
+			},
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.TrustedProxies = c.TrustedProxies
+		cfg.Resources = []*Resource{{URL: "/public", WhiteListed: true}}
+		_, _, svc := newTestProxyService(cfg)
+
+		var response testUpstreamResponse
+		resp, err := resty.New().R().SetHeaders(c.Headers).SetResult(&response).Get(svc + "/public")
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode(), "case %d", i)
+		for k, v := range c.Expected {
+			assert.Equal(t, v, response.Headers.Get(k), "case %d, header: %s", i, k)
+		}
+	}
+}
+
+func TestGetRedirectionURLForwarded(t *testing.T) {
+	cs := []struct {
+		TrustedProxies []string
+		Headers        map[string]string
+		Expected       string
+	}{
+		{
+			Headers:  map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"},
+			Expected: "http://127.0.0.1/oauth/callback",
+		},
+		{
+			TrustedProxies: []string{"127.0.0.1"},
+			Headers:        map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com"},
+			Expected:       "https://example.com/oauth/callback",
+		},
+		{
+			TrustedProxies: []string{"127.0.0.1"},
+			Headers:        map[string]string{"Forwarded": "for=1.1.1.1;proto=https;host=example.com"},
+			Expected:       "https://example.com/oauth/callback",
+		},
+	}
+	for i, c := range cs {
+		trusted, _ := parseCIDRs(c.TrustedProxies)
+		proxy := &oauthProxy{config: &Config{}, trustedProxies: trusted}
+		cx := newFakeGinContext(http.MethodGet, "/oauth/authorize")
+		for k, v := range c.Headers {
+			cx.Request.Header.Set(k, v)
+		}
+		assert.Equal(t, c.Expected, proxy.getRedirectionURL(cx), "case %d", i)
+	}
+}
+
+func TestParseRedirectionHost(t *testing.T) {
+	cs := []struct {
+		Value  string
+		Scheme string
+		Host   string
+		Ok     bool
+	}{
+		{Value: "app.example.com", Host: "app.example.com", Ok: true},
+		{Value: "App.Example.com:8443", Host: "app.example.com:8443", Ok: true},
+		{Value: "https://app.example.com", Scheme: "https", Host: "app.example.com", Ok: true},
+		{Value: "http://app.example.com:8080/", Scheme: "http", Host: "app.example.com:8080", Ok: true},
+		{Value: ""},
+		{Value: "ftp://app.example.com"},
+		{Value: "https://app.example.com/path"},
+		{Value: "https://user@app.example.com"},
+		{Value: "https://"},
+		{Value: "app.example.com/path"},
+	}
+	for i, c := range cs {
+		host, err := parseRedirectionHost(c.Value)
+		if !c.Ok {
+			assert.Error(t, err, "case %d, value: %s should have failed", i, c.Value)
+			continue
+		}
+		if assert.NoError(t, err, "case %d, value: %s should not have failed", i, c.Value) {
+			assert.Equal(t, c.Scheme, host.scheme, "case %d", i)
+			assert.Equal(t, c.Host, host.host, "case %d", i)
+		}
+	}
+}
+
+func TestGetRedirectionURLHosts(t *testing.T) {
+	var hosts []*redirectionHost
+	for _, x := range []string{"https://app.example.com", "other.example.com"} {
+		host, _ := parseRedirectionHost(x)
+		hosts = append(hosts, host)
+	}
+	trusted, _ := parseCIDRs([]string{"127.0.0.1"})
+	cs := []struct {
+		Host     string
+		Headers  map[string]string
+		Expected string
+	}{
+		{Host: "app.example.com", Expected: "https://app.example.com/oauth/callback"},
+		{Host: "APP.example.com", Expected: "https://app.example.com/oauth/callback"},
+		{Host: "other.example.com", Expected: "http://other.example.com/oauth/callback"},
+		{
+			Host:     "other.example.com",
+			Headers:  map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https"},
+			Expected: "https://other.example.com/oauth/callback",
+		},
+		{Host: "evil.com", Expected: "https://app.example.com/oauth/callback"},
+		{
+			Host:     "app.example.com",
+			Headers:  map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Host": "evil.com"},
+			Expected: "https://app.example.com/oauth/callback",
+		},
+	}
+	for i, c := range cs {
+		proxy := &oauthProxy{config: &Config{}, trustedProxies: trusted, redirectionHosts: hosts}
+		cx := newFakeGinContext(http.MethodGet, "/oauth/authorize")
+		cx.Request.Host = c.Host
+		for k, v := range c.Headers {
+			cx.Request.Header.Set(k, v)
+		}
+		assert.Equal(t, c.Expected, proxy.getRedirectionURL(cx), "case %d", i)
+	}
+}
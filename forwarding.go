@@ -23,6 +23,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oidc"
+	"github.com/gambol99/goproxy"
 	"github.com/gin-gonic/gin"
 )
 
@@ -55,16 +56,9 @@ func (r *oauthProxy) reverseProxyMiddleware() gin.HandlerFunc {
 	}
 }
 
-// forwardProxyHandler is responsible for signing outbound requests
-func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
-	// step: create oauth client
-	client, err := r.client.OAuthClient()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Fatal("failed to create an oauth client")
-	}
-
+// forwardProxyHandler is responsible for signing outbound requests; until the provider has been
+// discovered the requests which should be signed are answered with a 503
+func (r *oauthProxy) forwardProxyHandler() func(*http.Request) *http.Response {
 	// step: the loop state
 	var state struct {
 		// the access token
@@ -89,6 +83,23 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 
 			// step: do we have a access token
 			if state.login {
+				// step: we cannot login until the provider has been discovered
+				if !r.hasProvider() {
+					log.Warnf("the openid provider has not yet been discovered, unable to request an access token")
+
+					<-time.After(time.Duration(5) * time.Second)
+					continue
+				}
+				client, err := r.getClient().OAuthClient()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Error("failed to create an oauth client")
+
+					<-time.After(time.Duration(5) * time.Second)
+					continue
+				}
+
 				log.WithFields(log.Fields{
 					"username": r.config.ForwardingUsername,
 				}).Infof("requesting access token for user")
@@ -146,7 +157,7 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 					}).Infof("attempting to refresh the access token")
 
 					// step: attempt to refresh the access
-					token, expiration, err := getRefreshedToken(r.client, state.refresh)
+					token, refresh, expiration, err := getRefreshedToken(r.getClient(), state.refresh)
 					if err != nil {
 						state.login = true
 						switch err {
@@ -163,9 +174,12 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 						continue
 					}
 
-					// step: update the state
+					// step: update the state, the provider may have rotated the refresh token
 					state.token = token
 					state.expiration = expiration
+					if refresh != "" {
+						state.refresh = refresh
+					}
 					state.wait = true
 					state.login = false
 
@@ -203,15 +217,25 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 		}
 	}()
 
-	return func(req *http.Request, resp *http.Response) {
+	return func(req *http.Request) *http.Response {
 		hostname := req.Host
 		req.URL.Host = hostname
 
 		// step: does the host being signed?
 		if len(r.config.ForwardingDomains) == 0 || containsSubString(hostname, r.config.ForwardingDomains) {
+			if !r.hasProvider() {
+				log.WithFields(log.Fields{
+					"host": hostname,
+				}).Warnf("the openid provider has not yet been discovered, unable to sign the request")
+
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable,
+					"the openid provider has not yet been discovered")
+			}
 			// step: sign the outbound request with the access token
 			req.Header.Set("X-Forwarded-Agent", prog)
 			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", state.token.Encode()))
 		}
+
+		return nil
 	}
 }
@@ -26,6 +26,7 @@ import (
 	"net/http/pprof"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,16 +40,27 @@ func (r *oauthProxy) getRedirectionURL(cx *gin.Context) string {
 	var redirect string
 	switch r.config.RedirectionURL {
 	case "":
-		// need to determine the scheme, cx.Request.URL.Scheme doesn't have it, best way is to default
-		// and then check for TLS
-		scheme := "http"
-		if cx.Request.TLS != nil {
-			scheme = "https"
+		// step: the scheme and host are only taken from the forwarded headers of trusted proxies
+		forwarded := resolveForwarded(cx.Request, r.trustedProxies)
+		scheme, host := forwarded.proto, forwarded.host
+		// step: when the external hosts are restricted the url is only derived from those permitted,
+		// falling back to the first for anything else
+		if len(r.redirectionHosts) > 0 {
+			permitted := findRedirectionHost(r.redirectionHosts, host)
+			if permitted == nil {
+				permitted = r.redirectionHosts[0]
+				log.WithFields(log.Fields{
+					"client_ip": forwarded.clientIP.String(),
+					"default":   permitted.host,
+					"host":      host,
+				}).Warnf("the requested host is not a permitted redirection host, using the default")
+			}
+			host = permitted.host
+			if permitted.scheme != "" {
+				scheme = permitted.scheme
+			}
 		}
-		// @QUESTION: should I use the X-Forwarded-<header>?? ..
-		redirect = fmt.Sprintf("%s://%s",
-			defaultTo(cx.Request.Header.Get("X-Forwarded-Proto"), scheme),
-			defaultTo(cx.Request.Header.Get("X-Forwarded-Host"), cx.Request.Host))
+		redirect = fmt.Sprintf("%s://%s", scheme, host)
 	default:
 		redirect = r.config.RedirectionURL
 	}
@@ -80,14 +92,45 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		accessType = "offline"
 	}
 
-	authURL := client.AuthCodeURL(cx.Query("state"), accessType, "")
+	// step: attempt a silent authorization first, the cookie protects us from looping if the
+	// provider requires an interactive login; a step-up always requires an interactive login, and
+	// the fallback from a failed silent authorization would lose the step-up requirements
+	var prompt string
+	stepUp := cx.Query("acr_values") != "" || cx.Query("max_age") != ""
+	if r.config.EnableSilentAuthentication && !stepUp {
+		if _, err := cx.Request.Cookie(silentCookieName); err != nil {
+			prompt = "none"
+			r.dropSilentAuthCookie(cx)
+		}
+	}
+
+	authURL := client.AuthCodeURL(cx.Query("state"), accessType, prompt)
+
+	// step: pass through any step-up authentication requirements
+	if acr := cx.Query("acr_values"); acr != "" {
+		authURL += "&acr_values=" + url.QueryEscape(acr)
+	}
+	if maxAge := cx.Query("max_age"); maxAge != "" {
+		if _, err := strconv.Atoi(maxAge); err != nil {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		authURL += "&max_age=" + maxAge
+	}
 
 	log.WithFields(log.Fields{
 		"client_ip":   cx.ClientIP(),
 		"access_type": accessType,
 		"auth-url":    authURL,
+		"prompt":      prompt,
 	}).Debugf("incoming authorization request from client address: %s", cx.ClientIP())
 
+	// step: a silent authorization must go straight to the provider
+	if prompt == "none" {
+		r.redirectToURL(authURL, cx)
+		return
+	}
+
 	// step: if we have a custom sign in page, lets display that
 	if r.config.hasCustomSignInPage() {
 		// step: inject any custom tags into the context for the template
@@ -108,6 +151,26 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		cx.AbortWithStatus(http.StatusNotAcceptable)
 		return
 	}
+	// step: check if a silent authorization requires an interactive login
+	if isInteractionRequired(cx.Query("error")) {
+		if _, err := cx.Request.Cookie(silentCookieName); err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     cx.Query("error"),
+			}).Errorf("provider requires an interactive login but no silent authorization was attempted")
+
+			r.accessForbidden(cx)
+			return
+		}
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     cx.Query("error"),
+		}).Debugf("silent authorization failed, falling back to an interactive login")
+
+		r.redirectToURL(oauthURL+authorizationURL+"?state="+url.QueryEscape(cx.Query("state")), cx)
+		return
+	}
+
 	// step: ensure we have a authorization code to exchange
 	code := cx.Request.URL.Query().Get("code")
 	if code == "" {
@@ -143,7 +206,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 	}
 
 	// step: verify the token is valid
-	if err = verifyToken(r.client, token); err != nil {
+	if err = verifyToken(r.getVerifier(), token); err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to verify the id token")
 
 		r.accessForbidden(cx)
@@ -197,6 +260,11 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		r.dropAccessTokenCookie(cx, token.Encode(), identity.ExpiresAt.Sub(time.Now()))
 	}
 
+	// step: the silent authorization has completed
+	if r.config.EnableSilentAuthentication {
+		r.clearSilentAuthCookie(cx)
+	}
+
 	// step: decode the state variable
 	state := "/"
 	if cx.Request.URL.Query().Get("state") != "" {
@@ -230,7 +298,7 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 		}
 
 		// step: get the client
-		client, err := r.client.OAuthClient()
+		client, err := r.getClient().OAuthClient()
 		if err != nil {
 			return "unable to create the oauth client for user_credentials request", http.StatusInternalServerError, err
 		}
@@ -307,11 +375,11 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	}
 
 	// step: get the revocation endpoint from either the idp and or the user config
-	revocationURL := defaultTo(r.config.RevocationEndpoint, r.idp.EndSessionEndpoint.String())
+	revocationURL := defaultTo(r.config.RevocationEndpoint, r.getIDP().EndSessionEndpoint.String())
 
 	// step: do we have a revocation endpoint?
 	if revocationURL != "" {
-		client, err := r.client.OAuthClient()
+		client, err := r.getClient().OAuthClient()
 		if err != nil {
 			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to retrieve the openid client")
 
@@ -381,7 +449,7 @@ func (r *oauthProxy) expirationHandler(cx *gin.Context) {
 		return
 	}
 	// step: check the access is not expired
-	if user.isExpired() {
+	if user.isExpired(r.config.ClockSkew) {
 		cx.AbortWithError(http.StatusUnauthorized, err)
 		return
 	}
@@ -405,12 +473,60 @@ func (r *oauthProxy) tokenHandler(cx *gin.Context) {
 	cx.String(http.StatusOK, fmt.Sprintf("%s", user.token.Payload))
 }
 
+// notBeforeHandler accepts the not-before policy pushed from the keycloak admin console
+func (r *oauthProxy) notBeforeHandler(cx *gin.Context) {
+	if r.config.SkipTokenVerification {
+		cx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	content, err := ioutil.ReadAll(cx.Request.Body)
+	if err != nil {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	action, err := decodeNotBeforeAction(string(content), r.jwks.getKeys())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("invalid not-before admin action")
+
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	notBefore := time.Unix(action.NotBefore, 0)
+	r.notBefore.set(r.getIDP().Issuer.String(), action.Resource, notBefore)
+
+	log.WithFields(log.Fields{
+		"client":     action.Resource,
+		"not_before": notBefore.Format(time.RFC3339),
+	}).Infof("received a not-before policy from the admin console")
+
+	cx.AbortWithStatus(http.StatusOK)
+}
+
 // healthHandler is a health check handler for the service
 func (r *oauthProxy) healthHandler(cx *gin.Context) {
 	cx.Writer.Header().Set(versionHeader, version)
 	cx.String(http.StatusOK, "OK\n")
 }
 
+// readyHandler is a readiness check, indicating the provider has been discovered and keys are available
+func (r *oauthProxy) readyHandler(cx *gin.Context) {
+	status := r.getProviderStatus()
+	if r.config.SkipTokenVerification {
+		status.Ready = true
+	}
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	cx.Writer.Header().Set(versionHeader, version)
+	cx.JSON(code, status)
+}
+
 // debugHandler is responsible for providing the pprof
 func (r *oauthProxy) debugHandler(cx *gin.Context) {
 	name := cx.Param("name")
@@ -18,6 +18,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"testing"
 	"time"
@@ -279,6 +280,36 @@ func TestAuthorizationURL(t *testing.T) {
 	}
 }
 
+func TestAuthorizationURLStepUp(t *testing.T) {
+	_, _, u := newTestProxyService(nil)
+	cs := []struct {
+		URL          string
+		Expected     []string
+		ExpectedCode int
+	}{
+		{
+			URL:          "/oauth/authorize?state=L2FkbWlu&acr_values=2&max_age=600",
+			Expected:     []string{"acr_values=2", "max_age=600"},
+			ExpectedCode: http.StatusTemporaryRedirect,
+		},
+		{
+			URL:          "/oauth/authorize?state=L2FkbWlu&max_age=bad",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+c.URL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d, expected: %d", i, c.ExpectedCode)
+		for _, x := range c.Expected {
+			assert.Contains(t, resp.Header.Get("Location"), x, "case %d, expected: %s", i, x)
+		}
+	}
+}
+
 func TestCallbackURL(t *testing.T) {
 	_, _, u := newTestProxyService(nil)
 
@@ -333,6 +364,112 @@ func TestCallbackURL(t *testing.T) {
 	}
 }
 
+func TestSilentAuthentication(t *testing.T) {
+	cs := []struct {
+		LoginRequired bool
+		Prompts       []string
+	}{
+		{
+			Prompts: []string{"none"},
+		},
+		{
+			LoginRequired: true,
+			Prompts:       []string{"none", ""},
+		},
+	}
+	for i, c := range cs {
+		config := newFakeKeycloakConfig()
+		config.EnableSilentAuthentication = true
+		_, idp, u := newTestProxyService(config)
+		idp.setLoginRequired(c.LoginRequired)
+
+		jar, _ := cookiejar.New(nil)
+		resp, err := (&http.Client{Jar: jar}).Get(u + fakeAuthAllURL + "/test")
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d, expected: %d", i, http.StatusOK)
+		assert.Equal(t, c.Prompts, idp.getPrompts(), "case %d, expected: %v", i, c.Prompts)
+	}
+}
+
+func TestSilentAuthenticationNotAttempted(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSilentAuthentication = true
+	_, _, u := newTestProxyService(config)
+
+	req, _ := http.NewRequest("GET", u+oauthURL+callbackURL+"?state=L2FkbWlu&error=login_required", nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestSilentAuthenticationStepUp(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSilentAuthentication = true
+	_, _, u := newTestProxyService(config)
+
+	req, _ := http.NewRequest("GET", u+"/oauth/authorize?state=L2FkbWlu&acr_values=2&max_age=600", nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	assert.NotContains(t, location, "prompt=none")
+	assert.Contains(t, location, "acr_values=2")
+	assert.Contains(t, location, "max_age=600")
+	for _, x := range resp.Cookies() {
+		assert.NotEqual(t, silentCookieName, x.Name)
+	}
+}
+
+func TestNotBeforeHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableNotBeforePush = true
+	_, idp, u := newTestProxyService(config)
+	token, err := makeTestOauthLogin(u + "/admin")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	// step: the token should be permitted before the policy is pushed
+	resp, err := client.R().SetAuthToken(token).Get(u + "/auth_all/test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	cs := []struct {
+		Content  string
+		Expected int
+	}{
+		{
+			Content:  "not.a.token",
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Content:  newFakeNotBeforeAction(idp, "LOGOUT", time.Now().Add(time.Minute)),
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Content:  newFakeNotBeforeAction(idp, actionPushNotBefore, time.Now().Add(time.Minute)),
+			Expected: http.StatusOK,
+		},
+	}
+	for i, c := range cs {
+		resp, err := client.R().SetBody(c.Content).Post(u + oauthURL + notBeforeURL)
+		assert.NoError(t, err)
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+	}
+
+	// step: the token was issued before the policy and should be refused
+	req, _ := http.NewRequest("GET", u+"/auth_all/test", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultTransport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+}
+
 func TestHealthHandler(t *testing.T) {
 	svc := newTestService()
 	resp, err := resty.DefaultClient.R().Get(svc + oauthURL + healthURL)
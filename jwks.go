@@ -0,0 +1,272 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+var (
+	// jwksMinRefreshInterval is the minimum interval between refreshes triggered by unknown key ids
+	jwksMinRefreshInterval = time.Duration(10) * time.Second
+	// jwksRefreshInterval is the interval the keys are refreshed in the background
+	jwksRefreshInterval = time.Duration(1) * time.Hour
+)
+
+// jwksCache is the content of the jwks cache file
+type jwksCache struct {
+	// Issuer is the issuer the keys belong to
+	Issuer string `json:"issuer"`
+	// Keys are the public keys of the issuer
+	Keys []key.PublicKey `json:"keys"`
+}
+
+// remoteKeySet manages the keys retrieved from the provider, persisting the last good set to
+// disk and refreshing the keys when a token is signed by an unknown key id
+type remoteKeySet struct {
+	sync.RWMutex
+	// the public keys used to verify the tokens
+	keys []key.PublicKey
+	// the issuer of the keys
+	issuer string
+	// the client id expected in the audience
+	clientID string
+	// the leeway allowed on the time claims
+	leeway time.Duration
+	// the http client for the provider
+	hc *http.Client
+	// the jwks endpoint of the provider
+	endpoint string
+	// the file to persist the keys to
+	cacheFile string
+	// indicates the keys were loaded from the cache file
+	cached bool
+	// the lock held while refreshing the keys
+	refreshLock sync.Mutex
+	// the time of the last refresh attempt
+	lastRefresh time.Time
+}
+
+// newRemoteKeySet creates a key set for the configured issuer, loading any cached keys from disk
+func newRemoteKeySet(clientID, issuer, cacheFile string, leeway time.Duration) *remoteKeySet {
+	k := &remoteKeySet{
+		clientID:  clientID,
+		issuer:    issuer,
+		cacheFile: cacheFile,
+		leeway:    leeway,
+	}
+	if cacheFile != "" && fileExists(cacheFile) {
+		if err := k.load(); err != nil {
+			log.WithFields(log.Fields{
+				"filename": cacheFile,
+				"error":    err.Error(),
+			}).Warnf("unable to load the jwks cache file")
+		}
+	}
+
+	return k
+}
+
+// setProvider sets the provider the keys are retrieved from
+func (k *remoteKeySet) setProvider(issuer, endpoint string, hc *http.Client) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.issuer = issuer
+	k.endpoint = endpoint
+	k.hc = hc
+}
+
+// VerifyJWT verifies the claims and signature of the token, refreshing the keys if the key id is unknown
+func (k *remoteKeySet) VerifyJWT(token jose.JWT) error {
+	k.RLock()
+	issuer := k.issuer
+	k.RUnlock()
+
+	if err := verifyClaims(token, issuer, k.clientID, k.leeway); err != nil {
+		return err
+	}
+	// step: if the key is unknown we attempt a refresh of the keys
+	if kid, found := token.KeyID(); found && kid != "" && !k.hasKey(kid) {
+		if err := k.refresh(false); err != nil {
+			log.WithFields(log.Fields{
+				"kid":   kid,
+				"error": err.Error(),
+			}).Warnf("unable to refresh the keys for unknown key id")
+		}
+	}
+	verified, err := oidc.VerifySignature(token, k.getKeys())
+	if err != nil {
+		return fmt.Errorf("oidc: JWT signature verification failed: %v", err)
+	}
+	if !verified {
+		return errors.New("oidc: unable to verify JWT signature: no matching keys")
+	}
+
+	return nil
+}
+
+// getKeys returns the current keys
+func (k *remoteKeySet) getKeys() []key.PublicKey {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.keys
+}
+
+// hasKeys checks if we have any keys
+func (k *remoteKeySet) hasKeys() bool {
+	return len(k.getKeys()) > 0
+}
+
+// hasKey checks if we have the key id
+func (k *remoteKeySet) hasKey(kid string) bool {
+	for _, x := range k.getKeys() {
+		if x.ID() == kid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCached checks if the keys came from the cache file
+func (k *remoteKeySet) isCached() bool {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.cached
+}
+
+// refresh retrieves the keys from the provider, unless forced refreshes are rate limited
+func (k *remoteKeySet) refresh(force bool) error {
+	k.refreshLock.Lock()
+	defer k.refreshLock.Unlock()
+
+	if !force && time.Now().Sub(k.lastRefresh) < jwksMinRefreshInterval {
+		return errors.New("the keys were refreshed recently")
+	}
+	k.lastRefresh = time.Now()
+
+	k.RLock()
+	hc, endpoint, issuer := k.hc, k.endpoint, k.issuer
+	k.RUnlock()
+	if endpoint == "" {
+		return errors.New("the provider has not been discovered")
+	}
+
+	keySet, err := oidc.NewRemotePublicKeyRepo(hc, endpoint).Get()
+	if err != nil {
+		return err
+	}
+	keys := keySet.(*key.PublicKeySet).Keys()
+	if len(keys) <= 0 {
+		return errors.New("the provider has no keys")
+	}
+
+	k.Lock()
+	k.keys = keys
+	k.cached = false
+	k.Unlock()
+
+	if k.cacheFile != "" {
+		if err := k.save(issuer, keys); err != nil {
+			log.WithFields(log.Fields{
+				"filename": k.cacheFile,
+				"error":    err.Error(),
+			}).Warnf("unable to persist the keys to the jwks cache file")
+		}
+	}
+
+	return nil
+}
+
+// watch refreshes the keys in the background
+func (k *remoteKeySet) watch() {
+	go func() {
+		for {
+			time.Sleep(jwksRefreshInterval)
+			if err := k.refresh(true); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to refresh the provider keys")
+			}
+		}
+	}()
+}
+
+// load reads the keys from the cache file, refusing the keys of another issuer
+func (k *remoteKeySet) load() error {
+	content, err := ioutil.ReadFile(k.cacheFile)
+	if err != nil {
+		return err
+	}
+	var cache jwksCache
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return err
+	}
+	if len(cache.Keys) <= 0 {
+		return errors.New("the cache file has no keys")
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if strings.TrimSuffix(cache.Issuer, "/") != strings.TrimSuffix(k.issuer, "/") {
+		return fmt.Errorf("the issuer of the cache file: %s does not match the configured issuer: %s", cache.Issuer, k.issuer)
+	}
+	k.keys = cache.Keys
+	k.cached = true
+
+	log.Infof("loaded %d keys for issuer: %s from the jwks cache file", len(cache.Keys), cache.Issuer)
+
+	return nil
+}
+
+// save writes the keys to the cache file
+func (k *remoteKeySet) save(issuer string, keys []key.PublicKey) error {
+	content, err := json.Marshal(&jwksCache{Issuer: issuer, Keys: keys})
+	if err != nil {
+		return err
+	}
+	// step: write to a temporary file and rename, so we never leave a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(k.cacheFile), filepath.Base(k.cacheFile))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), k.cacheFile)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteKeySetUnknownKeyID(t *testing.T) {
+	interval := jwksMinRefreshInterval
+	jwksMinRefreshInterval = 0
+	defer func() { jwksMinRefreshInterval = interval }()
+
+	px, idp, svc := newTestProxyService(nil)
+	requests := idp.getKeyRequests()
+
+	// step: a token signed by a new key should trigger a refresh of the keys
+	idp.rotateKey("rotated-kid")
+	signed, err := idp.signToken(newTestToken(idp.getLocation()).claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, requests+1, idp.getKeyRequests())
+	assert.True(t, px.jwks.hasKey("rotated-kid"))
+
+	// step: the refreshes should be rate limited
+	jwksMinRefreshInterval = time.Hour
+	idp.rotateKey("limited-kid")
+	signed, _ = idp.signToken(newTestToken(idp.getLocation()).claims)
+	resp, err = resty.New().R().SetAuthToken(signed.Encode()).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+	assert.Equal(t, requests+1, idp.getKeyRequests())
+}
+
+func TestRemoteKeySetCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "jwks.json")
+
+	// step: the keys should be persisted on discovery
+	config := newFakeKeycloakConfig()
+	config.JWKSCacheFile = cacheFile
+	_, idp, _ := newTestProxyService(config)
+	content, err := ioutil.ReadFile(cacheFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var cache jwksCache
+	assert.NoError(t, json.Unmarshal(content, &cache))
+	assert.Equal(t, idp.getLocation(), cache.Issuer)
+	if assert.Len(t, cache.Keys, 1) {
+		assert.Equal(t, "test-kid", cache.Keys[0].ID())
+	}
+
+	// step: with the provider down we should verify bearer tokens from the cache
+	idp.setDiscoveryDown(true)
+	config = newFakeKeycloakConfig()
+	config.DiscoveryURL = idp.getLocation()
+	config.JWKSCacheFile = cacheFile
+	proxy, err := newProxy(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy.upstream = new(testReverseProxy)
+	svc := httptest.NewServer(proxy.router)
+
+	status := proxy.getProviderStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, "pending", status.Discovery)
+	assert.Equal(t, "cache", status.KeysSource)
+
+	signed, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+	cs := []struct {
+		Token    string
+		Expected int
+	}{
+		{Token: signed.Encode(), Expected: http.StatusOK},
+		{Expected: http.StatusServiceUnavailable},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", svc.URL+fakeAuthAllURL, nil)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d, expected: %d", i, c.Expected)
+	}
+}
+
+func TestRemoteKeySetBadCacheFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "jwks")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not json")
+	file.Close()
+
+	keys := newRemoteKeySet("test", "https://idp.example.com/auth/realms/test", file.Name(), 0)
+	assert.False(t, keys.hasKeys())
+	assert.Error(t, keys.refresh(true))
+}
+
+func TestRemoteKeySetForeignCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "jwks.json")
+
+	config := newFakeKeycloakConfig()
+	config.JWKSCacheFile = cacheFile
+	_, idp, _ := newTestProxyService(config)
+
+	cs := []struct {
+		Issuer   string
+		Expected bool
+	}{
+		{Issuer: idp.getLocation(), Expected: true},
+		{Issuer: idp.getLocation() + "/", Expected: true},
+		{Issuer: idp.getLocation() + "/.well-known/openid-configuration", Expected: true},
+		{Issuer: "https://other.example.com/auth/realms/hod-test"},
+		{Issuer: idp.getLocation() + "-other"},
+	}
+	for i, c := range cs {
+		config := &Config{DiscoveryURL: c.Issuer}
+		keys := newRemoteKeySet("test", config.getIssuer(), cacheFile, 0)
+		assert.Equal(t, c.Expected, keys.hasKeys(), "case %d, issuer: %s", i, c.Issuer)
+	}
+}
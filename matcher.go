@@ -0,0 +1,409 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// the kinds of segment in a resource pattern, ranked by their specificity
+const (
+	// segmentAny is a ** matching any remaining segments
+	segmentAny = iota
+	// segmentRegex is the remainder of a regex pattern
+	segmentRegex
+	// segmentParam is a named path parameter i.e. :id or {id}, matching any segment
+	segmentParam
+	// segmentWildcard is a * matching any segment
+	segmentWildcard
+	// segmentGlob is a segment containing glob characters i.e. v*
+	segmentGlob
+	// segmentPrefix is the last segment of a plain uri, matching segments starting with it
+	segmentPrefix
+	// segmentLiteral is a segment matched exactly
+	segmentLiteral
+)
+
+// patternSegment is a segment of a resource pattern
+type patternSegment struct {
+	// the kind of segment
+	kind int
+	// the literal, prefix, glob or name of the parameter
+	value string
+}
+
+// resourcePattern is a compiled resource uri
+type resourcePattern struct {
+	// the resource the pattern belongs to
+	resource *Resource
+	// the segments of the pattern
+	segments []patternSegment
+	// the regex of the pattern, if a regex uri
+	regex *regexp.Regexp
+	// the ranks of the complete segments of the literal prefix of the regex
+	regexRanks []int
+	// the position of the resource in the configuration
+	order int
+}
+
+// matcherNode is a node in the trie of resource patterns
+type matcherNode struct {
+	// the children keyed by a literal segment
+	literals map[string]*matcherNode
+	// the children matched by non-literal segments
+	edges []*matcherEdge
+	// the patterns ending at this node
+	terminal []*resourcePattern
+	// the patterns matching any remaining segments from this node
+	any []*resourcePattern
+}
+
+// matcherEdge is a non-literal segment leading to a node
+type matcherEdge struct {
+	segment patternSegment
+	node    *matcherNode
+}
+
+// resourceMatcher finds the most specific resource for a request; the plain uris and glob
+// patterns are compiled into a trie of path segments, with regex uris checked separately
+type resourceMatcher struct {
+	// the root of the trie
+	root *matcherNode
+	// the regex patterns
+	regexes []*resourcePattern
+	// the deny resources, checked before the others
+	deny *resourceMatcher
+}
+
+// resourceMatch is a candidate resource for the request
+type resourceMatch struct {
+	pattern *resourcePattern
+	ranks   []int
+	params  map[string]string
+}
+
+// newResourceMatcher compiles the resources into a matcher
+func newResourceMatcher(resources []*Resource) (*resourceMatcher, error) {
+	m := &resourceMatcher{root: newMatcherNode()}
+	for i, resource := range resources {
+		pattern, err := compileResourcePattern(resource.URL)
+		if err != nil {
+			return nil, err
+		}
+		pattern.resource = resource
+		pattern.order = i
+		target := m
+		if resource.Deny {
+			if m.deny == nil {
+				m.deny = &resourceMatcher{root: newMatcherNode()}
+			}
+			target = m.deny
+		}
+		target.add(pattern)
+	}
+
+	return m, nil
+}
+
+// add adds the pattern to the matcher
+func (m *resourceMatcher) add(pattern *resourcePattern) {
+	if pattern.regex != nil {
+		m.regexes = append(m.regexes, pattern)
+		return
+	}
+	m.root.insert(pattern)
+}
+
+func newMatcherNode() *matcherNode {
+	return &matcherNode{literals: make(map[string]*matcherNode)}
+}
+
+// compileResourcePattern parses the uri of a resource; a uri prefixed with ~ is a regex which must
+// match the complete path, a uri containing glob characters or path parameters is matched segment
+// by segment, while a plain uri retains the prefix matching i.e. /admin matches /admin, /admin/users
+// and /administrator
+func compileResourcePattern(uri string) (*resourcePattern, error) {
+	if strings.HasPrefix(uri, "~") {
+		// step: the regex must match the complete path, not merely a part of it
+		regex, err := regexp.Compile("^(?:" + strings.TrimPrefix(uri[1:], "^") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("the resource uri: %s is not a valid regex, error: %s", uri, err)
+		}
+		pattern := &resourcePattern{regex: regex}
+		// step: rank the complete segments of the literal prefix of the regex
+		prefix, _ := regex.LiteralPrefix()
+		if items := splitPath(prefix); len(items) > 1 {
+			for range items[:len(items)-1] {
+				pattern.regexRanks = append(pattern.regexRanks, segmentRank(patternSegment{kind: segmentLiteral}))
+			}
+		}
+
+		return pattern, nil
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return nil, fmt.Errorf("the resource uri: %s must start with a /", uri)
+	}
+
+	pattern := &resourcePattern{}
+	items := splitPath(uri)
+	plain := !strings.ContainsAny(uri, "*?[{") && !strings.Contains(uri, "/:")
+	for i, x := range items {
+		segment := patternSegment{kind: segmentLiteral, value: x}
+		switch {
+		case plain && i == len(items)-1:
+			segment.kind = segmentPrefix
+		case x == "**":
+			if i != len(items)-1 {
+				return nil, fmt.Errorf("the resource uri: %s may only have a ** as the last segment", uri)
+			}
+			segment.kind = segmentAny
+		case x == "*":
+			segment.kind = segmentWildcard
+		case strings.HasPrefix(x, ":") || (strings.HasPrefix(x, "{") && strings.HasSuffix(x, "}")):
+			segment.kind = segmentParam
+			segment.value = strings.TrimSuffix(strings.TrimLeft(x, ":{"), "}")
+			if segment.value == "" {
+				return nil, fmt.Errorf("the resource uri: %s has a path parameter without a name", uri)
+			}
+		case strings.ContainsAny(x, "*?["):
+			if _, err := path.Match(x, ""); err != nil {
+				return nil, fmt.Errorf("the resource uri: %s has an invalid glob: %s", uri, x)
+			}
+			segment.kind = segmentGlob
+		}
+		pattern.segments = append(pattern.segments, segment)
+	}
+
+	return pattern, nil
+}
+
+// getParams returns the names of the path parameters of the pattern
+func (r *resourcePattern) getParams() []string {
+	var list []string
+	if r.regex != nil {
+		for _, x := range r.regex.SubexpNames() {
+			if x != "" {
+				list = append(list, x)
+			}
+		}
+		return list
+	}
+	for _, x := range r.segments {
+		if x.kind == segmentParam {
+			list = append(list, x.value)
+		}
+	}
+
+	return list
+}
+
+// splitPath splits the path into segments, i.e. / is [""] and /a/ is ["a", ""]
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// insert adds the pattern to the trie
+func (n *matcherNode) insert(pattern *resourcePattern) {
+	node := n
+	for _, segment := range pattern.segments {
+		switch segment.kind {
+		case segmentAny:
+			node.any = append(node.any, pattern)
+			return
+		case segmentLiteral:
+			child, found := node.literals[segment.value]
+			if !found {
+				child = newMatcherNode()
+				node.literals[segment.value] = child
+			}
+			node = child
+		default:
+			node = node.edge(segment)
+		}
+		// step: a prefix matches any remaining segments
+		if segment.kind == segmentPrefix {
+			node.any = append(node.any, pattern)
+			return
+		}
+	}
+	node.terminal = append(node.terminal, pattern)
+}
+
+// edge returns the node for the non-literal segment, creating if required
+func (n *matcherNode) edge(segment patternSegment) *matcherNode {
+	for _, x := range n.edges {
+		if x.segment == segment {
+			return x.node
+		}
+	}
+	edge := &matcherEdge{segment: segment, node: newMatcherNode()}
+	n.edges = append(n.edges, edge)
+
+	return edge.node
+}
+
+// matches checks if the segment of the request matches the edge
+func (e *matcherEdge) matches(segment string) bool {
+	switch e.segment.kind {
+	case segmentPrefix:
+		return strings.HasPrefix(segment, e.segment.value)
+	case segmentGlob:
+		matched, _ := path.Match(e.segment.value, segment)
+		return matched
+	}
+
+	return true
+}
+
+// collect walks the trie for the segments of the request, passing each matching pattern
+func (n *matcherNode) collect(segments []string, ranks []int, params []string, found func(*resourcePattern, []int, []string)) {
+	for _, x := range n.any {
+		found(x, ranks, params)
+	}
+	if len(segments) <= 0 {
+		for _, x := range n.terminal {
+			found(x, ranks, params)
+		}
+		return
+	}
+	segment := segments[0]
+	if child, ok := n.literals[segment]; ok {
+		child.collect(segments[1:], appendRank(ranks, segmentRank(patternSegment{kind: segmentLiteral})), params, found)
+	}
+	for _, edge := range n.edges {
+		if !edge.matches(segment) {
+			continue
+		}
+		captured := params
+		if edge.segment.kind == segmentParam {
+			captured = append(append([]string{}, params...), edge.segment.value, segment)
+		}
+		edge.node.collect(segments[1:], appendRank(ranks, segmentRank(edge.segment)), captured, found)
+	}
+}
+
+// segmentRank returns the rank of the segment; prefixes and globs are further ranked by the
+// number of literal characters, while the empty prefix of a uri ending in / ranks as a **
+func segmentRank(segment patternSegment) int {
+	switch segment.kind {
+	case segmentPrefix:
+		if segment.value == "" {
+			return segmentAny << 16
+		}
+		return segmentPrefix<<16 + len(segment.value)
+	case segmentGlob:
+		return segmentGlob<<16 + len(strings.Trim(segment.value, "*?"))
+	}
+
+	return segment.kind << 16
+}
+
+// appendRank returns a copy of the ranks with the rank appended
+func appendRank(ranks []int, rank int) []int {
+	return append(append(make([]int, 0, len(ranks)+1), ranks...), rank)
+}
+
+// match returns the most specific resource matching the path and method of the request, along
+// with any path parameters; the specificity is compared segment by segment, literal segments over
+// prefixes, globs, wildcards and parameters, regexes and finally **, with the longer pattern
+// winning on an equal prefix and ties resolved by the order of the configuration. A resource
+// not covering the method is passed over, so the next most specific resource applies
+func (m *resourceMatcher) match(uri, method string) (*Resource, map[string]string) {
+	var best *resourceMatch
+	m.walk(uri, func(pattern *resourcePattern, ranks []int, params []string) {
+		if !pattern.resource.hasMethod(method) {
+			return
+		}
+		candidate := &resourceMatch{pattern: pattern, ranks: ranks}
+		if best != nil && !candidate.moreSpecific(best) {
+			return
+		}
+		candidate.params = make(map[string]string, len(params)/2)
+		for i := 0; i+1 < len(params); i += 2 {
+			candidate.params[params[i]] = params[i+1]
+		}
+		best = candidate
+	})
+	if best == nil {
+		return nil, nil
+	}
+
+	return best.pattern.resource, best.params
+}
+
+// denied returns the first deny resource, in the order of the configuration, matching the path
+// and method of the request; unlike the allows every matching deny resource is considered
+func (m *resourceMatcher) denied(uri, method string) *Resource {
+	if m.deny == nil {
+		return nil
+	}
+	var denied *resourcePattern
+	m.deny.walk(uri, func(pattern *resourcePattern, _ []int, _ []string) {
+		if !pattern.resource.hasMethod(method) {
+			return
+		}
+		if denied == nil || pattern.order < denied.order {
+			denied = pattern
+		}
+	})
+	if denied == nil {
+		return nil
+	}
+
+	return denied.resource
+}
+
+// walk calls consider for every pattern matching the uri
+func (m *resourceMatcher) walk(uri string, consider func(*resourcePattern, []int, []string)) {
+	segments := splitPath(uri)
+	m.root.collect(segments, nil, nil, consider)
+	for _, x := range m.regexes {
+		matches := x.regex.FindStringSubmatch(uri)
+		if matches == nil {
+			continue
+		}
+		// step: the named groups of the regex are the path parameters
+		var params []string
+		for i, name := range x.regex.SubexpNames() {
+			if name != "" && i < len(matches) {
+				params = append(params, name, matches[i])
+			}
+		}
+		// step: the segments after the literal prefix are ranked as matched by the regex
+		ranks := x.regexRanks
+		for len(ranks) < len(segments) {
+			ranks = appendRank(ranks, segmentRank(patternSegment{kind: segmentRegex}))
+		}
+		consider(x, ranks, params)
+	}
+}
+
+// moreSpecific checks if the match is more specific than the other
+func (r *resourceMatch) moreSpecific(other *resourceMatch) bool {
+	for i := 0; i < len(r.ranks) && i < len(other.ranks); i++ {
+		if r.ranks[i] != other.ranks[i] {
+			return r.ranks[i] > other.ranks[i]
+		}
+	}
+	if len(r.ranks) != len(other.ranks) {
+		return len(r.ranks) > len(other.ranks)
+	}
+
+	return r.pattern.order < other.pattern.order
+}
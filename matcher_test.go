@@ -0,0 +1,417 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileResourcePattern(t *testing.T) {
+	cs := []struct {
+		URI string
+		Ok  bool
+	}{
+		{URI: "/", Ok: true},
+		{URI: "/admin", Ok: true},
+		{URI: "/api/*/health", Ok: true},
+		{URI: "/api/v*/users/:id", Ok: true},
+		{URI: "/tenants/{tenant}/**", Ok: true},
+		{URI: "~^/api/v[0-9]+/.*$", Ok: true},
+		{URI: "admin"},
+		{URI: "/api/**/health"},
+		{URI: "/users/:"},
+		{URI: "/users/{}"},
+		{URI: "/api/[a-"},
+		{URI: "~^/api/(v1"},
+	}
+	for i, c := range cs {
+		_, err := compileResourcePattern(c.URI)
+		if c.Ok {
+			assert.NoError(t, err, "case %d, uri: %s should not have failed", i, c.URI)
+			continue
+		}
+		assert.Error(t, err, "case %d, uri: %s should have failed", i, c.URI)
+	}
+}
+
+func TestResourceMatcher(t *testing.T) {
+	resources := []*Resource{
+		{URL: "/"},
+		{URL: "/admin"},
+		{URL: "/admin/test"},
+		{URL: "/api/*/health"},
+		{URL: "/api/v*/users/:id"},
+		{URL: "/api/v1/users/me"},
+		{URL: "/tenants/{tenant}/**"},
+		{URL: "/tenants/{tenant}/billing/**"},
+		{URL: "~^/reports/[0-9]+$"},
+		{URL: "/reports/"},
+		{URL: "/files/**"},
+		{URL: "/files/*"},
+		{URL: "/dup"},
+		{URL: "/dup"},
+		{URL: "~^/orders/(?P<order>[0-9]+)/items/(?P<item>[0-9]+)$"},
+	}
+	m, err := newResourceMatcher(resources)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Path     string
+		Expected string
+		Params   map[string]string
+	}{
+		{Path: "/", Expected: "/"},
+		{Path: "/unknown", Expected: "/"},
+		{Path: "/admin", Expected: "/admin"},
+		{Path: "/administrator", Expected: "/admin"},
+		{Path: "/admin/users", Expected: "/admin"},
+		{Path: "/admin/test", Expected: "/admin/test"},
+		{Path: "/admin/test/more", Expected: "/admin/test"},
+		{Path: "/api/users/health", Expected: "/api/*/health"},
+		{Path: "/api/users/health/more", Expected: "/"},
+		{Path: "/api/v2/users/10", Expected: "/api/v*/users/:id", Params: map[string]string{"id": "10"}},
+		{Path: "/api/v1/users/me", Expected: "/api/v1/users/me"},
+		{Path: "/api/x2/users/10", Expected: "/"},
+		{Path: "/tenants/acme/users", Expected: "/tenants/{tenant}/**", Params: map[string]string{"tenant": "acme"}},
+		{Path: "/tenants/acme/billing/1", Expected: "/tenants/{tenant}/billing/**", Params: map[string]string{"tenant": "acme"}},
+		{Path: "/reports/10", Expected: "~^/reports/[0-9]+$"},
+		{Path: "/reports/all", Expected: "/reports/"},
+		{Path: "/files/a", Expected: "/files/*"},
+		{Path: "/files/a/b", Expected: "/files/**"},
+		{
+			Path:     "/orders/10/items/2",
+			Expected: "~^/orders/(?P<order>[0-9]+)/items/(?P<item>[0-9]+)$",
+			Params:   map[string]string{"order": "10", "item": "2"},
+		},
+	}
+	for i, c := range cs {
+		resource, params := m.match(c.Path, http.MethodGet)
+		if !assert.NotNil(t, resource, "case %d, path: %s should have matched", i, c.Path) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resource.URL, "case %d, path: %s", i, c.Path)
+		if c.Params != nil {
+			assert.Equal(t, c.Params, params, "case %d, path: %s", i, c.Path)
+		}
+	}
+	// step: ties are resolved by the order of the configuration
+	resource, _ := m.match("/dup", http.MethodGet)
+	assert.True(t, resource == resources[12])
+
+	// step: without a catch all nothing should match
+	m, _ = newResourceMatcher([]*Resource{{URL: "/admin/"}})
+	resource, _ = m.match("/admin", http.MethodGet)
+	assert.Nil(t, resource)
+}
+
+func TestPathParameterBindings(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/users/{id}/**", Methods: []string{"ANY"}, Bindings: map[string]string{"id": "sub"}},
+		{URL: "/tenants/:tenant", Methods: []string{"ANY"}, Bindings: map[string]string{"tenant": "tenants"}},
+		{URL: "/", Methods: []string{"ANY"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Claims   jose.Claims
+		Expected int
+	}{
+		{URL: "/users/1e11e539-8256-4b3b-bda8-cc0d56cddb48/profile", Expected: http.StatusOK},
+		{URL: "/users/someone-else/profile", Expected: http.StatusForbidden},
+		{URL: "/tenants/acme", Claims: jose.Claims{"tenants": []interface{}{"acme", "globex"}}, Expected: http.StatusOK},
+		{URL: "/tenants/initech", Claims: jose.Claims{"tenants": []interface{}{"acme", "globex"}}, Expected: http.StatusForbidden},
+		{URL: "/tenants/acme", Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		token.mergeClaims(c.Claims)
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s", i, c.URL)
+	}
+}
+
+func TestEntrypointMostSpecific(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{"admin"}},
+		{URL: "/admin/test", Methods: []string{"ANY"}, Roles: []string{"test"}},
+		{URL: "/api/*/health", WhiteListed: true},
+		{URL: "/api", Methods: []string{"ANY"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Roles    []string
+		HasToken bool
+		Expected int
+	}{
+		{URL: "/admin/test", HasToken: true, Roles: []string{"test"}, Expected: http.StatusOK},
+		{URL: "/admin/test", HasToken: true, Roles: []string{"admin"}, Expected: http.StatusForbidden},
+		{URL: "/admin", HasToken: true, Roles: []string{"admin"}, Expected: http.StatusOK},
+		{URL: "/api/users/health", Expected: http.StatusOK},
+		{URL: "/api/users", Expected: http.StatusUnauthorized},
+	}
+	for i, c := range cs {
+		client := resty.New().R()
+		if c.HasToken {
+			token := newTestToken(idp.getLocation())
+			token.setRealmsRoles(c.Roles)
+			signed, _ := idp.signToken(token.claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		resp, err := client.Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s", i, c.URL)
+	}
+}
+
+func TestResourceMatcherDenied(t *testing.T) {
+	resources := []*Resource{
+		{URL: "/api/**", Methods: []string{"DELETE"}, Deny: true},
+		{URL: "/api/admin", Methods: []string{"POST"}, Deny: true},
+		{URL: "~^/internal/.*$", Methods: []string{"ANY"}, Deny: true},
+		{URL: "/api/admin", Methods: []string{"ANY"}},
+		{URL: "/"},
+	}
+	m, err := newResourceMatcher(resources)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Path     string
+		Method   string
+		Expected string
+	}{
+		{Path: "/api/users", Method: "DELETE", Expected: "/api/**"},
+		{Path: "/api/admin", Method: "DELETE", Expected: "/api/**"},
+		{Path: "/api/admin", Method: "POST", Expected: "/api/admin"},
+		{Path: "/api/admin", Method: "GET"},
+		{Path: "/api/users", Method: "GET"},
+		{Path: "/internal/metrics", Method: "GET", Expected: "~^/internal/.*$"},
+		{Path: "/other", Method: "DELETE"},
+	}
+	for i, c := range cs {
+		resource := m.denied(c.Path, c.Method)
+		if c.Expected == "" {
+			assert.Nil(t, resource, "case %d, path: %s should not have been denied", i, c.Path)
+			continue
+		}
+		if assert.NotNil(t, resource, "case %d, path: %s should have been denied", i, c.Path) {
+			assert.Equal(t, c.Expected, resource.URL, "case %d, path: %s", i, c.Path)
+		}
+	}
+	// step: the deny resources are never selected as the allow
+	resource, _ := m.match("/api/users", http.MethodGet)
+	if assert.NotNil(t, resource) {
+		assert.Equal(t, "/", resource.URL)
+	}
+}
+
+func TestEntrypointDenyAndMethodRoles(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/api/public", WhiteListed: true},
+		{
+			URL:         "/api/reports",
+			Methods:     []string{"ANY"},
+			MethodRoles: map[string][]string{"GET": {"reader"}, "POST": {"writer"}},
+		},
+		{URL: "/api", Methods: []string{"ANY"}, Roles: []string{"admin"}},
+		{URL: "/api/**", Methods: []string{"DELETE"}, Deny: true},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Method   string
+		Roles    []string
+		HasToken bool
+		Expected int
+	}{
+		{URL: "/api/reports", Method: http.MethodGet, HasToken: true, Roles: []string{"reader"}, Expected: http.StatusOK},
+		{URL: "/api/reports", Method: http.MethodGet, HasToken: true, Roles: []string{"writer"}, Expected: http.StatusForbidden},
+		{URL: "/api/reports", Method: http.MethodPost, HasToken: true, Roles: []string{"writer"}, Expected: http.StatusOK},
+		{URL: "/api/reports", Method: http.MethodPost, HasToken: true, Roles: []string{"reader"}, Expected: http.StatusForbidden},
+		{URL: "/api/reports", Method: http.MethodPut, HasToken: true, Expected: http.StatusOK},
+		{URL: "/api/reports", Method: http.MethodDelete, HasToken: true, Roles: []string{"reader", "writer"}, Expected: http.StatusForbidden},
+		{URL: "/api/users", Method: http.MethodGet, HasToken: true, Roles: []string{"admin"}, Expected: http.StatusOK},
+		{URL: "/api/users", Method: http.MethodDelete, HasToken: true, Roles: []string{"admin"}, Expected: http.StatusForbidden},
+		{URL: "/api/public", Method: http.MethodGet, Expected: http.StatusOK},
+		{URL: "/api/public", Method: http.MethodDelete, Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		client := resty.New().R()
+		if c.HasToken {
+			token := newTestToken(idp.getLocation())
+			if len(c.Roles) > 0 {
+				token.setRealmsRoles(c.Roles)
+			}
+			signed, _ := idp.signToken(token.claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		resp, err := client.Execute(c.Method, svc+c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, %s %s", i, c.Method, c.URL)
+	}
+}
+
+func TestEntrypointMethodFallthrough(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{"admin"}},
+		{URL: "/admin/reports", Methods: []string{"POST"}, Roles: []string{"reports"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		Method   string
+		Roles    []string
+		HasToken bool
+		Expected int
+	}{
+		{Method: http.MethodGet, Expected: http.StatusUnauthorized},
+		{Method: http.MethodPost, Expected: http.StatusUnauthorized},
+		{Method: http.MethodGet, HasToken: true, Roles: []string{"reports"}, Expected: http.StatusForbidden},
+		{Method: http.MethodGet, HasToken: true, Roles: []string{"admin"}, Expected: http.StatusOK},
+		{Method: http.MethodPost, HasToken: true, Roles: []string{"reports"}, Expected: http.StatusOK},
+		{Method: http.MethodPost, HasToken: true, Roles: []string{"admin"}, Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		client := resty.New().R()
+		if c.HasToken {
+			token := newTestToken(idp.getLocation())
+			token.setRealmsRoles(c.Roles)
+			signed, _ := idp.signToken(token.claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		resp, err := client.Execute(c.Method, svc+"/admin/reports")
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, method: %s", i, c.Method)
+	}
+
+	// step: the matcher should pass over the resource not covering the method
+	m, _ := newResourceMatcher(cfg.Resources)
+	resource, _ := m.match("/admin/reports", http.MethodGet)
+	if assert.NotNil(t, resource) {
+		assert.Equal(t, "/admin", resource.URL)
+	}
+	resource, _ = m.match("/admin/reports", http.MethodPost)
+	if assert.NotNil(t, resource) {
+		assert.Equal(t, "/admin/reports", resource.URL)
+	}
+}
+
+func BenchmarkResourceMatcher(b *testing.B) {
+	var resources []*Resource
+	for i := 0; i < 500; i++ {
+		resources = append(resources, &Resource{URL: fmt.Sprintf("/service%d/api/*/health", i)})
+		resources = append(resources, &Resource{URL: fmt.Sprintf("/service%d/users/:id", i)})
+	}
+	resources = append(resources, &Resource{URL: "/"})
+	m, _ := newResourceMatcher(resources)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.match("/service250/users/10", http.MethodGet)
+	}
+}
+
+func TestResourceMatcherRegexAnchored(t *testing.T) {
+	m, err := newResourceMatcher([]*Resource{
+		{URL: "/"},
+		{URL: "~/public/.*"},
+		{URL: "/admin"},
+		{URL: "~/.*/shared/.*"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Path     string
+		Expected string
+	}{
+		{Path: "/public/x", Expected: "~/public/.*"},
+		{Path: "/admin/public/x", Expected: "/admin"},
+		{Path: "/secret/public/x", Expected: "/"},
+		{Path: "/admin/shared/x", Expected: "/admin"},
+		{Path: "/secret/shared/x", Expected: "~/.*/shared/.*"},
+	}
+	for i, c := range cs {
+		resource, _ := m.match(c.Path, http.MethodGet)
+		if !assert.NotNil(t, resource, "case %d, path: %s should have matched", i, c.Path) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resource.URL, "case %d, path: %s", i, c.Path)
+	}
+}
+
+func TestEntrypointRegexWhiteListed(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/", Methods: []string{"ANY"}, Roles: []string{"user"}},
+		{URL: "~/public/.*", Methods: []string{"ANY"}, WhiteListed: true},
+		{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{"admin"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		HasToken bool
+		Expected int
+	}{
+		{URL: "/public/x", Expected: http.StatusOK},
+		{URL: "/admin/public/x", Expected: http.StatusUnauthorized},
+		{URL: "/admin/public/x", HasToken: true, Expected: http.StatusForbidden},
+		{URL: "/secret/public/x", Expected: http.StatusUnauthorized},
+		{URL: "/secret/public/x", HasToken: true, Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		client := resty.New().R()
+		if c.HasToken {
+			token := newTestToken(idp.getLocation())
+			token.setRealmsRoles([]string{"user"})
+			signed, _ := idp.signToken(token.claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		resp, err := client.Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s", i, c.URL)
+	}
+}
@@ -18,6 +18,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
@@ -32,6 +33,8 @@ import (
 const (
 	// cxEnforce is the tag name for a request requiring
 	cxEnforce = "Enforcing"
+	// cxPathParams is the tag name for the path parameters of the resource
+	cxPathParams = "PathParams"
 )
 
 // filterMiddleware is custom filtering for incoming requests
@@ -50,6 +53,24 @@ func (r *oauthProxy) filterMiddleware() gin.HandlerFunc {
 	}
 }
 
+// scrubHeadersMiddleware removes the identity headers supplied by the client, the upstream can
+// only trust the X-Auth-* headers injected by the proxy. The names are compared with any _ as a -,
+// as the cgi style upstreams map X_Auth_Roles and X-Auth-Roles to the same variable
+func (r *oauthProxy) scrubHeadersMiddleware() gin.HandlerFunc {
+	scrub := make(map[string]bool, len(r.config.ScrubHeaders))
+	for _, x := range r.config.ScrubHeaders {
+		scrub[normalizeHeaderName(x)] = true
+	}
+
+	return func(cx *gin.Context) {
+		for name := range cx.Request.Header {
+			if normalized := normalizeHeaderName(name); strings.HasPrefix(normalized, "X-Auth-") || scrub[normalized] {
+				delete(cx.Request.Header, name)
+			}
+		}
+	}
+}
+
 // loggingMiddleware is a custom http logger
 func (r *oauthProxy) loggingMiddleware() gin.HandlerFunc {
 	return func(cx *gin.Context) {
@@ -99,25 +120,89 @@ func (r *oauthProxy) entrypointMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// step: check if authentication is required - gin doesn't support wildcard url
-		// so we have to use prefixes
-		for _, resource := range r.config.Resources {
-			if strings.HasPrefix(cx.Request.URL.Path, resource.URL) {
-				if resource.WhiteListed {
-					break
-				}
-				// step: inject the resource into the context, saves us from doing this again
-				if containedIn("ANY", resource.Methods) || containedIn(cx.Request.Method, resource.Methods) {
-					cx.Set(cxEnforce, resource)
-				}
-				break
+		// step: check the client is permitted to access the proxy
+		clientIP := getClientIP(cx.Request, r.trustedProxies)
+		if !r.networks.permits(clientIP) {
+			log.WithFields(log.Fields{
+				"access":    "denied",
+				"client_ip": clientIP.String(),
+				"uri":       cx.Request.URL.Path,
+			}).Warnf("access denied, the client address is not permitted")
+
+			r.accessForbidden(cx)
+			return
+		}
+
+		// step: the deny resources are checked before the others
+		if denied := r.resources.denied(cx.Request.URL.Path, cx.Request.Method); denied != nil {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"method":   cx.Request.Method,
+				"resource": denied.URL,
+				"uri":      cx.Request.URL.Path,
+			}).Warnf("access denied by a deny resource")
+
+			if r.denyAccess(cx, denied) {
+				return
+			}
+		}
+
+		// step: find the most specific resource for the request
+		resource, params := r.resources.match(cx.Request.URL.Path, cx.Request.Method)
+		if resource == nil {
+			return
+		}
+		// step: check the client is permitted to access the resource, including the white-listed
+		if !resource.networks.permits(clientIP) {
+			log.WithFields(log.Fields{
+				"access":    "denied",
+				"client_ip": clientIP.String(),
+				"resource":  resource.URL,
+				"uri":       cx.Request.URL.Path,
+			}).Warnf("access denied, the client address is not permitted by the resource")
+
+			if r.denyAccess(cx, resource) {
+				return
 			}
 		}
+		if resource.WhiteListed {
+			return
+		}
+		// step: inject the resource into the context, saves us from doing this again
+		cx.Set(cxEnforce, resource)
+		if len(params) > 0 {
+			cx.Set(cxPathParams, params)
+		}
+	}
+}
+
+// providerMiddleware ensures the openid provider is available for the handlers which require it
+func (r *oauthProxy) providerMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.config.SkipTokenVerification || r.hasProvider() {
+			return
+		}
+		if r.isProviderPending() {
+			log.WithFields(log.Fields{
+				"uri": cx.Request.URL.Path,
+			}).Warnf("the openid provider has not yet been discovered, unable to handle the request")
+
+			cx.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		log.WithFields(log.Fields{
+			"uri": cx.Request.URL.Path,
+		}).Warnf("no openid provider has been configured, unable to handle the request")
+
+		cx.AbortWithStatus(http.StatusNotImplemented)
 	}
 }
 
 // authenticationMiddleware is responsible for verifying the access token
 func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
+	// step: parse the refresh window, validated in the config
+	window, percent, _ := parseRefreshWindow(r.config.RefreshWindow)
+
 	return func(cx *gin.Context) {
 		// step: grab the client ip address - quicker to do once
 		clientIP := cx.ClientIP()
@@ -131,6 +216,16 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// step: we cannot verify the token until the provider has been discovered
+		if !r.config.SkipTokenVerification && r.isProviderPending() && r.getVerifier() == nil {
+			log.WithFields(log.Fields{
+				"uri": cx.Request.URL.Path,
+			}).Warnf("the openid provider has not yet been discovered, refusing the request")
+
+			cx.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+
 		// step: grab the user identity from the request
 		user, err := r.getIdentity(cx.Request)
 		if err != nil {
@@ -149,20 +244,40 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 		if r.config.SkipTokenVerification {
 			log.Warnf("skip token verification enabled, skipping verification process - FOR TESTING ONLY")
 
-			if user.isExpired() {
+			if err := verifyTimeClaims(user.claims, r.config.ClockSkew); err != nil {
 				log.WithFields(log.Fields{
 					"client_ip":  clientIP,
 					"username":   user.name,
 					"expired_on": user.expiresAt.String(),
-				}).Errorf("the session has expired and verification switch off")
+					"error":      err.Error(),
+				}).Errorf("the session is not valid and verification switch off")
 
+				if err != ErrAccessTokenExpired {
+					r.accessForbidden(cx)
+					return
+				}
 				r.redirectToAuthorization(cx)
 			}
 
 			return
 		}
 
-		if err := verifyToken(r.client, user.token); err != nil {
+		// step: check the token has not been revoked by a not-before policy
+		if r.notBefore.isRevoked(user) {
+			log.WithFields(log.Fields{
+				"client_ip": clientIP,
+				"email":     user.email,
+				"issued":    user.issuedAt.String(),
+			}).Warnf("access token was issued before the not-before policy, refusing the token")
+
+			if user.isCookie() {
+				r.clearAllCookies(cx)
+			}
+			r.redirectToAuthorization(cx)
+			return
+		}
+
+		if err := verifyToken(r.getVerifier(), user.token); err != nil {
 			// step: if the error post verification is anything other than a token expired error
 			// we immediately throw an access forbidden - as there is something messed up in the token
 			if err != ErrAccessTokenExpired {
@@ -206,7 +321,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			}
 
 			// attempt to refresh the access token
-			token, _, err := getRefreshedToken(r.client, refresh)
+			token, rotated, err := r.refreshAccessToken(user, refresh)
 			if err != nil {
 				switch err {
 				case ErrRefreshTokenExpired:
@@ -224,36 +339,25 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				return
 			}
 
-			// get the expiration of the new access token
-			expiresIn := r.getAccessCookieExpiration(token, refresh)
-
-			log.WithFields(log.Fields{
-				"client_ip":   clientIP,
-				"cookie_name": r.config.CookieAccessName,
-				"email":       user.email,
-				"expires_in":  expiresIn.String(),
-			}).Infof("injecting the refreshed access token cookie")
-
-			// step: inject the refreshed access token
-			r.dropAccessTokenCookie(cx, token.Encode(), expiresIn)
-
-			if r.useStore() {
-				go func(old, new jose.JWT, state string) {
-					if err := r.DeleteRefreshToken(old); err != nil {
-						log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to remove old token")
-					}
-					if err := r.StoreRefreshToken(new, state); err != nil {
-						log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to store refresh token")
-						return
-					}
-				}(user.token, token, refresh)
+			r.injectRefreshedToken(cx, user, token, refresh, rotated)
+		} else if r.config.EnableRefreshTokens && user.isCookie() && isWithinRefreshWindow(user, window, percent) {
+			// step: the access token is close to expiry, attempt to roll the session forward - a failure
+			// here is not fatal as the access token is still valid
+			refresh, err := r.retrieveRefreshToken(cx.Request, user)
+			if err == nil {
+				var token jose.JWT
+				var rotated string
+				if token, rotated, err = r.refreshAccessToken(user, refresh); err == nil {
+					r.injectRefreshedToken(cx, user, token, refresh, rotated)
+				}
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"client_ip": clientIP,
+					"email":     user.email,
+					"error":     err.Error(),
+				}).Warnf("unable to proactively refresh the access token")
 			}
-
-			// step: update the with the new access token
-			user.token = token
-
-			// step: inject the user into the context
-			cx.Set(userContextName, user)
 		}
 
 		cx.Next()
@@ -290,9 +394,34 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// step: check the session has the required authentication strength
+		if !user.hasAuthentication(resource.ACR, resource.MaxAge) {
+			log.WithFields(log.Fields{
+				"access":    "denied",
+				"acr":       user.acr,
+				"auth_time": user.authTime.String(),
+				"email":     user.email,
+				"resource":  resource.URL,
+				"required":  resource.ACR,
+			}).Warnf("session does not meet the authentication requirements of the resource")
+
+			if !user.isBearer() && !r.isReportOnly(resource) {
+				r.redirectToStepUp(cx, resource)
+				return
+			}
+			if r.denyAccess(cx, resource) {
+				return
+			}
+		} else if resource.ACR != "" || resource.MaxAge > 0 {
+			// step: the requirements are met, clear any step up attempt
+			if _, err := cx.Request.Cookie(stepUpCookieName); err == nil {
+				r.clearStepUpCookie(cx)
+			}
+		}
+
 		// step: we need to check the roles
 		if roles := len(resource.Roles); roles > 0 {
-			if !hasRoles(resource.Roles, user.roles) {
+			if !resource.hasRoles(user.roles) {
 				log.WithFields(log.Fields{
 					"access":   "denied",
 					"email":    user.email,
@@ -300,7 +429,52 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"required": resource.getRoles(),
 				}).Warnf("access denied, invalid roles")
 
-				r.accessForbidden(cx)
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+		}
+
+		// step: check the roles required for the method
+		if !resource.hasMethodRoles(cx.Request.Method, user.roles) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"email":    user.email,
+				"method":   cx.Request.Method,
+				"resource": resource.URL,
+				"required": resource.getMethodRoles(cx.Request.Method),
+			}).Warnf("access denied, invalid roles for the method")
+
+			if r.denyAccess(cx, resource) {
+				return
+			}
+		}
+
+		// step: check the user is a member of the groups
+		if len(resource.Groups) > 0 && !resource.hasGroups(user.groups) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"email":    user.email,
+				"groups":   user.getGroups(),
+				"resource": resource.URL,
+				"required": resource.getGroups(),
+			}).Warnf("access denied, not a member of the groups")
+
+			if r.denyAccess(cx, resource) {
+				return
+			}
+		}
+
+		// step: evaluate the expression of the resource
+		if resource.expression != nil && !resource.expression.evaluate(user) {
+			log.WithFields(log.Fields{
+				"access":     "denied",
+				"email":      user.email,
+				"resource":   resource.URL,
+				"expression": resource.Expression,
+			}).Warnf("access denied, the expression was not satisfied")
+
+			if r.denyAccess(cx, resource) {
 				return
 			}
 		}
@@ -317,8 +491,10 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"error":    err.Error(),
 				}).Errorf("unable to extract the claim from token")
 
-				r.accessForbidden(cx)
-				return
+				if r.denyAccess(cx, resource) {
+					return
+				}
+				continue
 			}
 
 			if !found {
@@ -329,8 +505,10 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"claim":    claimName,
 				}).Warnf("the token does not have the claim")
 
-				r.accessForbidden(cx)
-				return
+				if r.denyAccess(cx, resource) {
+					return
+				}
+				continue
 			}
 
 			// step: check the claim is the same
@@ -344,8 +522,108 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"required": match,
 				}).Warnf("the token claims does not match claim requirement")
 
-				r.accessForbidden(cx)
-				return
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+		}
+
+		// step: check the path parameters are bound to the claims of the user
+		if len(resource.Bindings) > 0 {
+			params, _ := cx.Get(cxPathParams)
+			values, _ := params.(map[string]string)
+			if name, found := resource.hasBindings(values, user.claims); !found {
+				log.WithFields(log.Fields{
+					"access":    "denied",
+					"claim":     resource.Bindings[name],
+					"email":     user.email,
+					"parameter": name,
+					"resource":  resource.URL,
+					"value":     values[name],
+				}).Warnf("the path parameter is not bound to the claims of the user")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+		}
+
+		// step: check the claims required by the resource
+		for name, matcher := range resource.claimMatchers {
+			if values := getClaimValues(user.claims, name); !matcher.matches(values) {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"claim":    name,
+					"email":    user.email,
+					"issued":   strings.Join(values, ","),
+					"required": resource.Claims[name],
+					"resource": resource.URL,
+				}).Warnf("the token claims do not match the resource claim requirement")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+		}
+
+		// step: evaluate the rule of the resource
+		if resource.rule != nil {
+			params, _ := cx.Get(cxPathParams)
+			values, _ := params.(map[string]string)
+			allowed, err := resource.rule.evaluate(newPolicyVariables(cx.Request, values, user))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"email":    user.email,
+					"error":    err.Error(),
+					"resource": resource.URL,
+					"rule":     resource.When,
+				}).Errorf("unable to evaluate the rule of the resource")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			} else if !allowed {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"email":    user.email,
+					"resource": resource.URL,
+					"rule":     resource.When,
+				}).Warnf("access denied, the rule was not satisfied")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+		}
+
+		// step: consult the external authorizer
+		if r.authorizer != nil {
+			decision, err := r.authorizer.authorize(cx.Request, user, resource)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"email":    user.email,
+					"error":    err.Error(),
+					"resource": resource.URL,
+				}).Errorf("unable to retrieve a decision from the external authorizer")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			} else if !decision.Allow {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"email":    user.email,
+					"resource": resource.URL,
+				}).Warnf("access denied by the external authorizer")
+
+				if r.denyAccess(cx, resource) {
+					return
+				}
+			}
+			for k, v := range decision.Headers {
+				cx.Request.Header.Set(k, v)
 			}
 		}
 
@@ -358,26 +636,29 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 	}
 }
 
-// corsMiddleware injects the CORS headers, if set, for request made to /oauth
-func (r *oauthProxy) corsMiddleware(c Cors) gin.HandlerFunc {
+// corsMiddleware injects the CORS headers, using the cors options of the resource if any, and
+// answers the preflight requests before they reach the authentication
+func (r *oauthProxy) corsMiddleware(policy *corsPolicy) gin.HandlerFunc {
 	return func(cx *gin.Context) {
-		if len(c.Origins) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Origin", strings.Join(c.Origins, ","))
-		}
-		if c.Credentials {
-			cx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		}
-		if len(c.ExposedHeaders) > 0 {
-			cx.Writer.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ","))
-		}
-		if len(c.Methods) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ","))
+		// step: use the cors options of the resource, if any
+		options := policy
+		preflight := isPreflightRequest(cx.Request)
+		if r.resources != nil && !strings.HasPrefix(cx.Request.URL.Path, oauthURL) {
+			// step: a preflight is matched on the method being requested
+			method := cx.Request.Method
+			if preflight {
+				method = cx.Request.Header.Get("Access-Control-Request-Method")
+			}
+			if resource, _ := r.resources.match(cx.Request.URL.Path, method); resource != nil && resource.cors != nil {
+				options = resource.cors
+			}
 		}
-		if len(c.Headers) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ","))
+		if options == nil || len(options.Origins) <= 0 {
+			return
 		}
-		if c.MaxAge > 0 {
-			cx.Writer.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.MaxAge.Seconds())))
+		options.inject(cx.Writer.Header(), cx.Request, preflight)
+		if preflight {
+			cx.AbortWithStatus(http.StatusNoContent)
 		}
 	}
 }
@@ -409,6 +690,7 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 			cx.Request.Header.Set("X-Auth-ExpiresIn", id.expiresAt.String())
 			cx.Request.Header.Set("X-Auth-Token", id.token.Encode())
 			cx.Request.Header.Set("X-Auth-Roles", strings.Join(id.roles, ","))
+			cx.Request.Header.Set("X-Auth-Groups", strings.Join(id.groups, ","))
 
 			// step: add the authorization header if requested
 			if r.config.EnableAuthorizationHeader {
@@ -421,11 +703,13 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 					cx.Request.Header.Set(header, fmt.Sprintf("%v", claim))
 				}
 			}
+		} else if r.config.EnableAuthorizationHeader {
+			// step: the upstream expects the authorization header to come from the proxy
+			cx.Request.Header.Del("Authorization")
 		}
 
-		cx.Request.Header.Add("X-Forwarded-For", cx.Request.RemoteAddr)
-		cx.Request.Header.Set("X-Forwarded-Host", cx.Request.Host)
-		cx.Request.Header.Set("X-Forwarded-Proto", cx.Request.Header.Get("X-Forwarded-Proto"))
+		// step: set the forwarded headers, discarding those not set by the trusted proxies
+		setForwardedHeaders(cx.Request, r.trustedProxies)
 	}
 }
 
@@ -23,6 +23,7 @@ import (
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/go-resty/resty"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -161,12 +162,20 @@ func TestRolePermissionsMiddleware(t *testing.T) {
 			Roles:     []string{"bad_role"},
 			Expects:   http.StatusForbidden,
 		},
-		{ // token, wrong roles, no 'get' method
+		{ // token, wrong roles, no 'post' method falls to the catch all
 			URI:       fakeTestRoleURL,
 			Method:    http.MethodPost,
 			Redirects: false,
 			HasToken:  true,
 			Roles:     []string{"bad_role"},
+			Expects:   http.StatusForbidden,
+		},
+		{ // token, roles of the catch all, no 'post' method
+			URI:       fakeTestRoleURL,
+			Method:    http.MethodPost,
+			Redirects: false,
+			HasToken:  true,
+			Roles:     []string{fakeTestRole},
 			Expects:   http.StatusOK,
 		},
 		{ // check with correct token
@@ -294,17 +303,18 @@ func TestCrossSiteHandler(t *testing.T) {
 				Origins: []string{"*", "https://examples.com"},
 			},
 			Headers: map[string]string{
-				"Access-Control-Allow-Origin": "*,https://examples.com",
+				"Access-Control-Allow-Origin": "*",
 			},
 		},
 		{
 			Cors: Cors{
-				Origins: []string{"*", "https://examples.com"},
-				Methods: []string{"GET", "POST"},
+				Origins:        []string{"*", "https://examples.com"},
+				Methods:        []string{"GET", "POST"},
+				ExposedHeaders: []string{"X-Request-Id"},
 			},
 			Headers: map[string]string{
-				"Access-Control-Allow-Origin":  "*,https://examples.com",
-				"Access-Control-Allow-Methods": "GET,POST",
+				"Access-Control-Allow-Origin":   "*",
+				"Access-Control-Expose-Headers": "X-Request-Id",
 			},
 		},
 	}
@@ -508,6 +518,207 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 	}
 }
 
+func TestAdmissionHandlerGroups(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/dev",
+			Methods: []string{"ANY"},
+			Groups:  []string{"/org/dev"},
+		},
+		{
+			URL:     "/ops",
+			Methods: []string{"ANY"},
+			Groups:  []string{"ops"},
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Groups   []interface{}
+		Expected int
+	}{
+		{URL: "/dev", Groups: []interface{}{"/org/dev"}, Expected: http.StatusOK},
+		{URL: "/dev", Groups: []interface{}{"/org/dev/backend"}, Expected: http.StatusOK},
+		{URL: "/dev", Groups: []interface{}{"/org/ops"}, Expected: http.StatusForbidden},
+		{URL: "/dev", Expected: http.StatusForbidden},
+		{URL: "/ops", Groups: []interface{}{"/ops"}, Expected: http.StatusOK},
+		{URL: "/ops", Groups: []interface{}{"/org/ops"}, Expected: http.StatusForbidden},
+		{URL: "/ops", Groups: []interface{}{"/org/dev"}, Expected: http.StatusForbidden},
+		{URL: "/", Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		if c.Groups != nil {
+			token.claims.Add("groups", c.Groups)
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		var response testUpstreamResponse
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).SetResult(&response).Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+		if c.Expected == http.StatusOK && c.Groups != nil {
+			assert.Equal(t, c.Groups[0], response.Headers.Get("X-Auth-Groups"), "case %d", i)
+		}
+	}
+}
+
+func TestAdmissionHandlerMatchAndExpression(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/any",
+			Methods: []string{"ANY"},
+			Roles:   []string{"admin", "auditor"},
+			Match:   "any",
+		},
+		{
+			URL:     "/all",
+			Methods: []string{"ANY"},
+			Roles:   []string{"admin", "auditor"},
+		},
+		{
+			URL:        "/expression",
+			Methods:    []string{"ANY"},
+			Expression: "(role:admin or group:/org/ops) and not claim:contractor=true",
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Roles    []string
+		Claims   jose.Claims
+		Expected int
+	}{
+		{URL: "/any", Roles: []string{"auditor"}, Expected: http.StatusOK},
+		{URL: "/any", Roles: []string{"admin"}, Expected: http.StatusOK},
+		{URL: "/any", Roles: []string{"user"}, Expected: http.StatusForbidden},
+		{URL: "/all", Roles: []string{"auditor"}, Expected: http.StatusForbidden},
+		{URL: "/all", Roles: []string{"admin", "auditor"}, Expected: http.StatusOK},
+		{URL: "/expression", Roles: []string{"admin"}, Expected: http.StatusOK},
+		{
+			URL:      "/expression",
+			Claims:   jose.Claims{"groups": []interface{}{"/org/ops/oncall"}},
+			Expected: http.StatusOK,
+		},
+		{
+			URL:      "/expression",
+			Roles:    []string{"admin"},
+			Claims:   jose.Claims{"contractor": true},
+			Expected: http.StatusForbidden,
+		},
+		{URL: "/expression", Roles: []string{"user"}, Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		if len(c.Roles) > 0 {
+			token.setRealmsRoles(c.Roles)
+		}
+		token.mergeClaims(c.Claims)
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s, expected: %d", i, c.URL, c.Expected)
+	}
+}
+
+func TestAdmissionHandlerRules(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/finance",
+			Methods: []string{"ANY"},
+			When:    "'finance' in claims.groups && request.method != 'DELETE'",
+		},
+		{
+			URL:     "/tenants/{tenant}",
+			Methods: []string{"ANY"},
+			When:    "request.params.tenant == claims.tenant",
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Method   string
+		Claims   jose.Claims
+		Expected int
+	}{
+		{
+			URL:      "/finance",
+			Method:   http.MethodGet,
+			Claims:   jose.Claims{"groups": []interface{}{"finance"}},
+			Expected: http.StatusOK,
+		},
+		{
+			URL:      "/finance",
+			Method:   http.MethodDelete,
+			Claims:   jose.Claims{"groups": []interface{}{"finance"}},
+			Expected: http.StatusForbidden,
+		},
+		{
+			URL:      "/finance",
+			Method:   http.MethodGet,
+			Claims:   jose.Claims{"groups": []interface{}{"sales"}},
+			Expected: http.StatusForbidden,
+		},
+		{
+			URL:      "/finance",
+			Method:   http.MethodGet,
+			Expected: http.StatusForbidden,
+		},
+		{
+			URL:      "/tenants/acme",
+			Method:   http.MethodGet,
+			Claims:   jose.Claims{"tenant": "acme"},
+			Expected: http.StatusOK,
+		},
+		{
+			URL:      "/tenants/other",
+			Method:   http.MethodGet,
+			Claims:   jose.Claims{"tenant": "acme"},
+			Expected: http.StatusForbidden,
+		},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		token.mergeClaims(c.Claims)
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Execute(c.Method, svc+c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s, expected: %d", i, c.URL, c.Expected)
+	}
+}
+
 func TestRolesAdmissionHandlerClaims(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.NoRedirects = true
@@ -591,3 +802,285 @@ func TestRolesAdmissionHandlerClaims(t *testing.T) {
 		}
 	}
 }
+
+func TestAdmissionHandlerStepUp(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+			ACR:     "2",
+			MaxAge:  time.Duration(10) * time.Minute,
+		},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+
+	cs := []struct {
+		Claims       jose.Claims
+		Cookie       bool
+		StepUp       bool
+		Expected     int
+		ExpectedURL  string
+		DropsStepUp  bool
+		ClearsStepUp bool
+	}{
+		{
+			Claims:   jose.Claims{"acr": "1", "auth_time": float64(time.Now().Unix())},
+			Expected: http.StatusForbidden,
+		},
+		{
+			Claims:      jose.Claims{"acr": "1", "auth_time": float64(time.Now().Unix())},
+			Cookie:      true,
+			Expected:    http.StatusTemporaryRedirect,
+			ExpectedURL: "/oauth/authorize?state=L2FkbWlu&acr_values=2&max_age=600",
+			DropsStepUp: true,
+		},
+		{
+			Claims:   jose.Claims{"acr": "1", "auth_time": float64(time.Now().Unix())},
+			Cookie:   true,
+			StepUp:   true,
+			Expected: http.StatusForbidden,
+		},
+		{
+			Claims:       jose.Claims{"acr": "2", "auth_time": float64(time.Now().Unix())},
+			Cookie:       true,
+			StepUp:       true,
+			Expected:     http.StatusOK,
+			ClearsStepUp: true,
+		},
+		{
+			Claims:      jose.Claims{"acr": "2", "auth_time": float64(time.Now().Add(-1 * time.Hour).Unix())},
+			Cookie:      true,
+			Expected:    http.StatusTemporaryRedirect,
+			ExpectedURL: "/oauth/authorize?state=L2FkbWlu&acr_values=2&max_age=600",
+			DropsStepUp: true,
+		},
+		{
+			Claims:   jose.Claims{"acr": "2", "auth_time": float64(time.Now().Unix())},
+			Expected: http.StatusOK,
+		},
+		{
+			Claims:   jose.Claims{"acr": "3", "auth_time": float64(time.Now().Unix())},
+			Cookie:   true,
+			Expected: http.StatusOK,
+		},
+	}
+	for i, c := range cs {
+		token := newTestToken(idp.getLocation())
+		token.mergeClaims(c.Claims)
+		jwt, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		req, _ := http.NewRequest("GET", svc+"/admin", nil)
+		if c.Cookie {
+			req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: jwt.Encode()})
+		} else {
+			req.Header.Set("Authorization", "Bearer "+jwt.Encode())
+		}
+		if c.StepUp {
+			req.AddCookie(&http.Cookie{Name: stepUpCookieName, Value: "true"})
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d failed, expected: %d but got: %d", i, c.Expected, resp.StatusCode)
+		assert.Equal(t, c.ExpectedURL, resp.Header.Get("Location"), "case %d failed, expected: %s", i, c.ExpectedURL)
+		// step: check the step up attempt cookie is dropped on a redirect and cleared once satisfied
+		var stepUp *http.Cookie
+		for _, x := range resp.Cookies() {
+			if x.Name == stepUpCookieName {
+				stepUp = x
+			}
+		}
+		switch {
+		case c.DropsStepUp:
+			assert.True(t, stepUp != nil && stepUp.Value == "true", "case %d, expected the step up cookie", i)
+		case c.ClearsStepUp:
+			assert.True(t, stepUp != nil && stepUp.Value == "", "case %d, expected the step up cookie cleared", i)
+		default:
+			assert.Nil(t, stepUp, "case %d, unexpected step up cookie", i)
+		}
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	cs := []struct {
+		ReportOnly bool
+		Resources  []*Resource
+		URL        string
+		Method     string
+		Roles      []string
+		Expected   int
+		Reported   float64
+	}{
+		{
+			Resources: []*Resource{{URL: "/report-admin", Methods: []string{"ANY"}, Roles: []string{"admin"}, ReportOnly: true}},
+			URL:       "/report-admin",
+			Roles:     []string{"user"},
+			Expected:  http.StatusOK,
+			Reported:  1,
+		},
+		{
+			Resources: []*Resource{{URL: "/report-checks", Methods: []string{"ANY"}, Roles: []string{"admin"}, When: "request.method == 'POST'", ReportOnly: true}},
+			URL:       "/report-checks",
+			Roles:     []string{"user"},
+			Expected:  http.StatusOK,
+			Reported:  2,
+		},
+		{
+			Resources: []*Resource{{URL: "/report-permitted", Methods: []string{"ANY"}, Roles: []string{"admin"}, ReportOnly: true}},
+			URL:       "/report-permitted",
+			Roles:     []string{"admin"},
+			Expected:  http.StatusOK,
+		},
+		{
+			Resources: []*Resource{{URL: "/report-enforced", Methods: []string{"ANY"}, Roles: []string{"admin"}}},
+			URL:       "/report-enforced",
+			Roles:     []string{"user"},
+			Expected:  http.StatusForbidden,
+		},
+		{
+			ReportOnly: true,
+			Resources:  []*Resource{{URL: "/report-global", Methods: []string{"ANY"}, When: "request.method == 'GET'"}},
+			URL:        "/report-global",
+			Method:     http.MethodPost,
+			Expected:   http.StatusOK,
+			Reported:   1,
+		},
+		{
+			Resources: []*Resource{
+				{URL: "/report-deny", Methods: []string{"DELETE"}, Deny: true, ReportOnly: true},
+				{URL: "/report-deny", Methods: []string{"ANY"}, Roles: []string{"admin"}},
+			},
+			URL:      "/report-deny",
+			Method:   http.MethodDelete,
+			Roles:    []string{"user"},
+			Expected: http.StatusForbidden,
+			Reported: 1,
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.NoRedirects = true
+		cfg.ReportOnly = c.ReportOnly
+		cfg.Resources = c.Resources
+		proxy, idp, svc := newTestProxyService(cfg)
+
+		token := newTestToken(idp.getLocation())
+		if len(c.Roles) > 0 {
+			token.setRealmsRoles(c.Roles)
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		method := c.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Execute(method, svc+c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, %s %s", i, method, c.URL)
+
+		var metric dto.Metric
+		proxy.reportDenials.WithLabelValues(c.URL).Write(&metric)
+		assert.Equal(t, c.Reported, metric.GetCounter().GetValue(), "case %d, the reported denials", i)
+	}
+}
+
+func TestScrubHeaders(t *testing.T) {
+	cs := []struct {
+		EnableAuthorizationHeader bool
+		URL                       string
+		HasToken                  bool
+		Headers                   map[string]string
+		Expected                  map[string]string
+	}{
+		{
+			URL: "/public",
+			Headers: map[string]string{
+				"X-Auth-Roles":     "admin",
+				"X-Auth-Email":     "admin@example.com",
+				"X-Auth-Tenant":    "acme",
+				"X-Internal-User":  "admin",
+				"X-Request-Id":     "10",
+				"Authorization":    "Bearer fake",
+				"X-Auth-Something": "x",
+			},
+			Expected: map[string]string{
+				"X-Auth-Roles":     "",
+				"X-Auth-Email":     "",
+				"X-Auth-Tenant":    "",
+				"X-Auth-Something": "",
+				"X-Internal-User":  "",
+				"X-Request-Id":     "10",
+				"Authorization":    "Bearer fake",
+			},
+		},
+		{
+			URL: "/public",
+			Headers: map[string]string{
+				"X_Auth_Roles":    "admin",
+				"x_auth_email":    "admin@example.com",
+				"X_Internal_User": "admin",
+				"X_Request_Id":    "10",
+			},
+			Expected: map[string]string{
+				"X_Auth_Roles":    "",
+				"x_auth_email":    "",
+				"X_Internal_User": "",
+				"X_Request_Id":    "10",
+			},
+		},
+		{
+			EnableAuthorizationHeader: true,
+			URL:                       "/public",
+			Headers:                   map[string]string{"Authorization": "Bearer fake"},
+			Expected: map[string]string{
+				"Authorization": "",
+			},
+		},
+		{
+			URL:      "/auth_all/test",
+			HasToken: true,
+			Headers:  map[string]string{"X-Auth-Roles": "admin", "X-Auth-Tenant": "acme"},
+			Expected: map[string]string{
+				"X-Auth-Roles":  "",
+				"X-Auth-Tenant": "",
+				"X-Auth-Email":  "gambol99@gmail.com",
+			},
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableAuthorizationHeader = c.EnableAuthorizationHeader
+		cfg.ScrubHeaders = []string{"x-internal-user"}
+		cfg.Resources = []*Resource{
+			{URL: "/public", WhiteListed: true},
+			{URL: "/auth_all", Methods: []string{"ANY"}},
+		}
+		_, idp, svc := newTestProxyService(cfg)
+
+		client := resty.New().R()
+		for k, v := range c.Headers {
+			client.SetHeader(k, v)
+		}
+		if c.HasToken {
+			signed, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		var response testUpstreamResponse
+		resp, err := client.SetResult(&response).Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode(), "case %d", i)
+		for k, v := range c.Expected {
+			assert.Equal(t, v, response.Headers.Get(k), "case %d, header: %s", i, k)
+		}
+	}
+}
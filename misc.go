@@ -19,6 +19,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"time"
 
@@ -38,6 +39,31 @@ func (r *oauthProxy) accessForbidden(cx *gin.Context) {
 	cx.AbortWithStatus(http.StatusForbidden)
 }
 
+// denyAccess denies the request to the resource, unless the resource is in report-only mode, in
+// which case the would-be denial is logged and counted and the request permitted; returns true
+// when the request was denied
+func (r *oauthProxy) denyAccess(cx *gin.Context, resource *Resource) bool {
+	if !r.isReportOnly(resource) {
+		r.accessForbidden(cx)
+		return true
+	}
+	log.WithFields(log.Fields{
+		"access":   "report-only",
+		"method":   cx.Request.Method,
+		"resource": resource.URL,
+		"uri":      cx.Request.URL.Path,
+	}).Warnf("the request would have been denied, permitting as the resource is in report-only mode")
+
+	r.reportDenials.WithLabelValues(resource.URL).Inc()
+
+	return false
+}
+
+// isReportOnly checks if the denials of the resource are reported rather than enforced
+func (r *oauthProxy) isReportOnly(resource *Resource) bool {
+	return r.config.ReportOnly || resource.ReportOnly
+}
+
 // redirectToURL redirects the user and aborts the context
 func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 	cx.Redirect(http.StatusTemporaryRedirect, url)
@@ -46,7 +72,11 @@ func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
-	if r.config.NoRedirects {
+	if !r.config.SkipTokenVerification && r.isProviderPending() {
+		cx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	if r.config.NoRedirects || (!r.config.SkipTokenVerification && !r.hasProvider()) {
 		cx.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
@@ -65,6 +95,47 @@ func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
 	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
 }
 
+// redirectToStepUp redirects the user to authorization handler requesting a stronger authentication
+func (r *oauthProxy) redirectToStepUp(cx *gin.Context, resource *Resource) {
+	if !r.config.SkipTokenVerification && r.isProviderPending() {
+		cx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	if r.config.NoRedirects || (!r.config.SkipTokenVerification && !r.hasProvider()) {
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	authQuery := fmt.Sprintf("?state=%s", base64.StdEncoding.EncodeToString([]byte(cx.Request.URL.RequestURI())))
+	if resource.ACR != "" {
+		authQuery += "&acr_values=" + url.QueryEscape(resource.ACR)
+	}
+	if resource.MaxAge > 0 {
+		authQuery += fmt.Sprintf("&max_age=%d", int64(resource.MaxAge.Seconds()))
+	}
+
+	if r.config.SkipTokenVerification {
+		log.Errorf("refusing to redirection to authorization endpoint, skip token verification switched on")
+
+		cx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	// step: the provider was unable to meet the requirements on the last attempt, we deny rather
+	// than redirecting the user in a loop
+	if _, err := cx.Request.Cookie(stepUpCookieName); err == nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"resource":  resource.URL,
+		}).Warnf("the step up authorization did not meet the requirements of the resource")
+
+		r.accessForbidden(cx)
+		return
+	}
+	r.dropStepUpCookie(cx)
+
+	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
+}
+
 // getAccessCookieExpiration calucates the expiration of the access token cookie
 func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) time.Duration {
 	// notes: by default the duration of the access token will be the configuration option, if
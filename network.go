@@ -0,0 +1,109 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// networkPolicy restricts the source addresses of the requests
+type networkPolicy struct {
+	// the networks permitted, when empty all are permitted
+	allowed []*net.IPNet
+	// the networks denied, checked before the allowed
+	denied []*net.IPNet
+}
+
+// newNetworkPolicy parses the allowed and denied cidrs
+func newNetworkPolicy(allowed, denied []string) (*networkPolicy, error) {
+	var err error
+	p := &networkPolicy{}
+	if p.allowed, err = parseCIDRs(allowed); err != nil {
+		return nil, err
+	}
+	if p.denied, err = parseCIDRs(denied); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// isEmpty checks if the policy has no restrictions
+func (p *networkPolicy) isEmpty() bool {
+	return p == nil || (len(p.allowed) <= 0 && len(p.denied) <= 0)
+}
+
+// permits checks the address is permitted by the policy
+func (p *networkPolicy) permits(ip net.IP) bool {
+	if p.isEmpty() {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(p.denied, ip) {
+		return false
+	}
+
+	return len(p.allowed) <= 0 || containsIP(p.allowed, ip)
+}
+
+// parseCIDRs parses a list of cidrs, a bare address is treated as a single host
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, x := range cidrs {
+		x = strings.TrimSpace(x)
+		if !strings.Contains(x, "/") {
+			ip := net.ParseIP(x)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", x)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s, error: %s", x, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP checks if any of the networks contain the address
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, x := range networks {
+		if x.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getClientIP returns the address of the client, the forwarded headers are only honored when the
+// request came from a trusted proxy
+func getClientIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	return resolveForwarded(req, trusted).clientIP
+}
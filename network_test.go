@@ -0,0 +1,202 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	cs := []struct {
+		CIDRs []string
+		Ok    bool
+	}{
+		{CIDRs: []string{"10.0.0.0/8", "192.168.1.0/24"}, Ok: true},
+		{CIDRs: []string{"127.0.0.1", " ::1 "}, Ok: true},
+		{CIDRs: []string{"fd00::/8"}, Ok: true},
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{CIDRs: []string{"bad"}},
+		{CIDRs: []string{""}},
+	}
+	for i, c := range cs {
+		_, err := parseCIDRs(c.CIDRs)
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have failed", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestNetworkPolicyPermits(t *testing.T) {
+	cs := []struct {
+		Allowed  []string
+		Denied   []string
+		IP       string
+		Expected bool
+	}{
+		{IP: "8.8.8.8", Expected: true},
+		{Allowed: []string{"10.0.0.0/8"}, IP: "10.1.2.3", Expected: true},
+		{Allowed: []string{"10.0.0.0/8"}, IP: "8.8.8.8"},
+		{Allowed: []string{"10.0.0.0/8"}, Denied: []string{"10.1.0.0/16"}, IP: "10.1.2.3"},
+		{Allowed: []string{"10.0.0.0/8"}, Denied: []string{"10.1.0.0/16"}, IP: "10.2.2.3", Expected: true},
+		{Denied: []string{"192.168.0.1"}, IP: "192.168.0.1"},
+		{Denied: []string{"192.168.0.1"}, IP: "192.168.0.2", Expected: true},
+		{Allowed: []string{"::1"}, IP: "::1", Expected: true},
+		{Allowed: []string{"10.0.0.0/8"}},
+	}
+	for i, c := range cs {
+		policy, err := newNetworkPolicy(c.Allowed, c.Denied)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, policy.permits(net.ParseIP(c.IP)), "case %d, ip: %s", i, c.IP)
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8", "127.0.0.1"})
+	cs := []struct {
+		RemoteAddr string
+		Forwarded  []string
+		Expected   string
+	}{
+		{RemoteAddr: "8.8.8.8:1234", Expected: "8.8.8.8"},
+		{RemoteAddr: "8.8.8.8:1234", Forwarded: []string{"192.168.1.1"}, Expected: "8.8.8.8"},
+		{RemoteAddr: "127.0.0.1:1234", Forwarded: []string{"192.168.1.1"}, Expected: "192.168.1.1"},
+		{RemoteAddr: "127.0.0.1:1234", Forwarded: []string{"1.1.1.1, 192.168.1.1, 10.0.0.2"}, Expected: "192.168.1.1"},
+		{RemoteAddr: "127.0.0.1:1234", Forwarded: []string{"1.1.1.1", "192.168.1.1"}, Expected: "192.168.1.1"},
+		{RemoteAddr: "127.0.0.1:1234", Forwarded: []string{"10.0.0.3, 10.0.0.2"}, Expected: "10.0.0.3"},
+		{RemoteAddr: "127.0.0.1:1234", Forwarded: []string{"1.1.1.1, bad"}, Expected: "<nil>"},
+		{RemoteAddr: "127.0.0.1:1234", Expected: "127.0.0.1"},
+		{RemoteAddr: "[::1]:1234", Forwarded: []string{"192.168.1.1"}, Expected: "::1"},
+	}
+	for i, c := range cs {
+		req := &http.Request{RemoteAddr: c.RemoteAddr, Header: make(http.Header)}
+		for _, x := range c.Forwarded {
+			req.Header.Add("X-Forwarded-For", x)
+		}
+		assert.Equal(t, c.Expected, getClientIP(req, trusted).String(), "case %d", i)
+	}
+}
+
+func TestEntrypointNetworks(t *testing.T) {
+	cs := []struct {
+		AllowedCIDRs   []string
+		TrustedProxies []string
+		Resources      []*Resource
+		URL            string
+		Forwarded      string
+		Headers        map[string]string
+		HasToken       bool
+		Expected       int
+	}{
+		{
+			Resources: []*Resource{{URL: "/admin", Methods: []string{"ANY"}, AllowedCIDRs: []string{"10.8.0.0/16"}}},
+			URL:       "/admin",
+			HasToken:  true,
+			Expected:  http.StatusForbidden,
+		},
+		{
+			TrustedProxies: []string{"127.0.0.1"},
+			Resources:      []*Resource{{URL: "/admin", Methods: []string{"ANY"}, AllowedCIDRs: []string{"10.8.0.0/16"}}},
+			URL:            "/admin",
+			Forwarded:      "10.8.1.1",
+			HasToken:       true,
+			Expected:       http.StatusOK,
+		},
+		{
+			Resources: []*Resource{{URL: "/admin", Methods: []string{"ANY"}, AllowedCIDRs: []string{"10.8.0.0/16"}}},
+			URL:       "/admin",
+			Forwarded: "10.8.1.1",
+			HasToken:  true,
+			Expected:  http.StatusForbidden,
+		},
+		{
+			TrustedProxies: []string{"127.0.0.1"},
+			Resources:      []*Resource{{URL: "/admin", Methods: []string{"ANY"}, AllowedCIDRs: []string{"10.8.0.0/16"}}},
+			URL:            "/admin",
+			Forwarded:      "10.8.1.1",
+			Expected:       http.StatusUnauthorized,
+		},
+		{
+			Resources: []*Resource{{URL: "/health", WhiteListed: true, AllowedCIDRs: []string{"127.0.0.0/8"}}},
+			URL:       "/health",
+			Expected:  http.StatusOK,
+		},
+		{
+			Resources: []*Resource{{URL: "/health", WhiteListed: true, DeniedCIDRs: []string{"127.0.0.1"}}},
+			URL:       "/health",
+			Expected:  http.StatusForbidden,
+		},
+		{
+			AllowedCIDRs: []string{"10.0.0.0/8"},
+			Resources:    []*Resource{{URL: "/health", WhiteListed: true}},
+			URL:          "/health",
+			Expected:     http.StatusForbidden,
+		},
+		{
+			AllowedCIDRs: []string{"127.0.0.1"},
+			Resources:    []*Resource{{URL: "/health", WhiteListed: true}},
+			URL:          "/health",
+			Expected:     http.StatusOK,
+		},
+		{
+			AllowedCIDRs:   []string{"127.0.0.0/8"},
+			TrustedProxies: []string{"127.0.0.1"},
+			Resources:      []*Resource{{URL: "/health", WhiteListed: true}},
+			URL:            "/health",
+			Headers:        map[string]string{"Forwarded": `for="1.1.1.1`},
+			Expected:       http.StatusForbidden,
+		},
+		{
+			AllowedCIDRs:   []string{"127.0.0.0/8"},
+			TrustedProxies: []string{"127.0.0.1"},
+			Resources:      []*Resource{{URL: "/health", WhiteListed: true}},
+			URL:            "/health",
+			Forwarded:      "1.1.1.1, bad",
+			Expected:       http.StatusForbidden,
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.NoRedirects = true
+		cfg.AllowedCIDRs = c.AllowedCIDRs
+		cfg.TrustedProxies = c.TrustedProxies
+		cfg.Resources = c.Resources
+		_, idp, svc := newTestProxyService(cfg)
+
+		client := resty.New().R()
+		if c.HasToken {
+			signed, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+			client.SetAuthToken(signed.Encode())
+		}
+		if c.Forwarded != "" {
+			client.SetHeader("X-Forwarded-For", c.Forwarded)
+		}
+		client.SetHeaders(c.Headers)
+		resp, err := client.Get(svc + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, url: %s", i, c.URL)
+	}
+}
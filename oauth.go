@@ -16,6 +16,8 @@ limitations under the License.
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -27,24 +29,26 @@ import (
 
 // getOAuthClient returns a oauth2 client from the openid client
 func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, error) {
-	return oauth2.NewClient(r.idpClient, oauth2.Config{
+	idp := r.getIDP()
+
+	return oauth2.NewClient(r.getIDPClient(), oauth2.Config{
 		Credentials: oauth2.ClientCredentials{
 			ID:     r.config.ClientID,
 			Secret: r.config.ClientSecret,
 		},
 		RedirectURL: redirectionURL,
-		AuthURL:     r.idp.AuthEndpoint.String(),
-		TokenURL:    r.idp.TokenEndpoint.String(),
+		AuthURL:     idp.AuthEndpoint.String(),
+		TokenURL:    idp.TokenEndpoint.String(),
 		Scope:       append(r.config.Scopes, oidc.DefaultScope...),
 		AuthMethod:  oauth2.AuthMethodClientSecretBasic,
 	})
 }
 
 // verifyToken verify that the token in the user context is valid
-func verifyToken(client *oidc.Client, token jose.JWT) error {
+func verifyToken(verifier tokenVerifier, token jose.JWT) error {
 	// step: verify the token is whom they say they are
-	if err := client.VerifyJWT(token); err != nil {
-		if strings.Contains(err.Error(), "token is expired") {
+	if err := verifier.VerifyJWT(token); err != nil {
+		if err == ErrAccessTokenExpired || strings.Contains(err.Error(), "token is expired") {
 			return ErrAccessTokenExpired
 		}
 
@@ -54,28 +58,89 @@ func verifyToken(client *oidc.Client, token jose.JWT) error {
 	return nil
 }
 
-// getRefreshedToken attempts to refresh the access token, returning the parsed token and the time it expires or a error
-func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, time.Time, error) {
+// verifyClaims verifies the issuer, audience and time claims of the token, the time claims are
+// permitted the leeway to cater for clock drift between the provider and the proxy
+func verifyClaims(token jose.JWT, issuer, clientID string, leeway time.Duration) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	if err := verifyTimeClaims(claims, leeway); err != nil {
+		return err
+	}
+	// step: ensure the token was issued by the issuer
+	iss, found, err := claims.StringClaim(claimIssuer)
+	if err != nil || !found {
+		return errors.New("missing claim: 'iss'")
+	}
+	if strings.TrimSuffix(iss, "/") != strings.TrimSuffix(issuer, "/") {
+		return fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", issuer, iss)
+	}
+	// step: ensure the client is in the audience
+	if aud, found, err := claims.StringClaim(claimAudience); err == nil && found {
+		if aud != clientID {
+			return fmt.Errorf("invalid claims, 'aud' claim and 'client_id' do not match, aud=%s, client_id=%s", aud, clientID)
+		}
+	} else if aud, found, err := claims.StringsClaim(claimAudience); err == nil && found {
+		if !containedIn(clientID, aud) {
+			return fmt.Errorf("invalid claims, cannot find 'client_id' in 'aud' claim, aud=%v, client_id=%s", aud, clientID)
+		}
+	} else {
+		return errors.New("invalid claim value: 'aud' is required, and should be either string or string array")
+	}
+
+	return nil
+}
+
+// verifyTimeClaims checks the exp, nbf and iat claims of the token, allowing for the leeway; only
+// the exp claim is required, the nbf and iat claims are checked when present
+func verifyTimeClaims(claims jose.Claims, leeway time.Duration) error {
+	now := time.Now()
+
+	expires, found, err := claims.TimeClaim(claimExpiration)
+	if err != nil || !found {
+		return errors.New("missing claim: 'exp'")
+	}
+	if expires.Add(leeway).Before(now) {
+		return ErrAccessTokenExpired
+	}
+	if notBefore, found, err := claims.TimeClaim(claimNotBefore); err != nil {
+		return errors.New("invalid claim value: 'nbf'")
+	} else if found && notBefore.After(now.Add(leeway)) {
+		return ErrAccessTokenNotValidYet
+	}
+	if issuedAt, found, err := claims.TimeClaim(claimIssuedAt); err != nil {
+		return errors.New("invalid claim value: 'iat'")
+	} else if found && issuedAt.After(now.Add(leeway)) {
+		return ErrAccessTokenIssuedInFuture
+	}
+
+	return nil
+}
+
+// getRefreshedToken attempts to refresh the access token, returning the parsed token, the refresh token issued
+// with it (if any) and the time it expires or a error
+func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, string, time.Time, error) {
 	// step: retrieve the client
 	cl, err := client.OAuthClient()
 	if err != nil {
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 	response, err := getToken(cl, oauth2.GrantTypeRefreshToken, t)
 	if err != nil {
 		if strings.Contains(err.Error(), "token expired") {
-			return jose.JWT{}, time.Time{}, ErrRefreshTokenExpired
+			return jose.JWT{}, "", time.Time{}, ErrRefreshTokenExpired
 		}
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 
 	// step: parse the access token
 	token, identity, err := parseToken(response.AccessToken)
 	if err != nil {
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 
-	return token, identity.ExpiresAt, nil
+	return token, response.RefreshToken, identity.ExpiresAt, nil
 }
 
 // exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	crand "crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -31,6 +32,8 @@ import (
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oauth2"
 	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
 )
 
 type fakeOAuthServer struct {
@@ -45,6 +48,18 @@ type fakeOAuthServer struct {
 	signer jose.Signer
 	// the claims
 	claims jose.Claims
+	// the number of refresh grants performed
+	refreshes int
+	// the delay to apply to the refresh grants
+	refreshDelay time.Duration
+	// indicates the user has no sso session, prompt=none will fail
+	loginRequired bool
+	// the prompts received by the authorization endpoint
+	prompts []string
+	// indicates the discovery endpoint is unavailable
+	discoveryDown bool
+	// the number of requests for the keys
+	keyRequests int
 }
 
 const fakePrivateKey = `
@@ -172,7 +187,37 @@ func (r *fakeOAuthServer) getRevocationURL() string {
 }
 
 func (r *fakeOAuthServer) signToken(claims jose.Claims) (*jose.JWT, error) {
-	return jose.NewSignedJWT(claims, r.signer)
+	r.Lock()
+	signer := r.signer
+	r.Unlock()
+	return jose.NewSignedJWT(claims, signer)
+}
+
+// rotateKey replaces the signing key of the realm
+func (r *fakeOAuthServer) rotateKey(kid string) *fakeOAuthServer {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		panic("failed to generate the private key, error: " + err.Error())
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.privateKey = privateKey
+	r.key = jose.JWK{
+		ID:       kid,
+		Type:     "RSA",
+		Alg:      "RS256",
+		Use:      "sig",
+		Exponent: privateKey.PublicKey.E,
+		Modulus:  privateKey.PublicKey.N,
+	}
+	r.signer = jose.NewSignerRSA(kid, *privateKey)
+	return r
+}
+
+func (r *fakeOAuthServer) getKeyRequests() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.keyRequests
 }
 
 func (r *fakeOAuthServer) setUserRealmRoles(roles []string) *fakeOAuthServer {
@@ -182,12 +227,48 @@ func (r *fakeOAuthServer) setUserRealmRoles(roles []string) *fakeOAuthServer {
 	return r
 }
 
+func (r *fakeOAuthServer) setRefreshDelay(delay time.Duration) *fakeOAuthServer {
+	r.refreshDelay = delay
+	return r
+}
+
+func (r *fakeOAuthServer) setLoginRequired(required bool) *fakeOAuthServer {
+	r.loginRequired = required
+	return r
+}
+
+func (r *fakeOAuthServer) getPrompts() []string {
+	r.Lock()
+	defer r.Unlock()
+	return r.prompts
+}
+
+func (r *fakeOAuthServer) setDiscoveryDown(down bool) *fakeOAuthServer {
+	r.Lock()
+	defer r.Unlock()
+	r.discoveryDown = down
+	return r
+}
+
+func (r *fakeOAuthServer) getRefreshes() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.refreshes
+}
+
 func (r *fakeOAuthServer) setUserExpiration(duration time.Duration) *fakeOAuthServer {
 	r.claims["exp"] = time.Now().Add(duration).Second()
 	return r
 }
 
 func (r *fakeOAuthServer) discoveryHandler(cx *gin.Context) {
+	r.Lock()
+	down := r.discoveryDown
+	r.Unlock()
+	if down {
+		cx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
 	cx.JSON(http.StatusOK, fakeDiscoveryResponse{
 		IDTokenSigningAlgValuesSupported: []string{"RS256"},
 		Issuer:                     fmt.Sprintf("http://%s/auth/realms/hod-test", r.location.Host),
@@ -206,6 +287,9 @@ func (r *fakeOAuthServer) discoveryHandler(cx *gin.Context) {
 }
 
 func (r *fakeOAuthServer) keysHandler(cx *gin.Context) {
+	r.Lock()
+	defer r.Unlock()
+	r.keyRequests++
 	cx.JSON(http.StatusOK, jose.JWKSet{Keys: []jose.JWK{r.key}})
 }
 
@@ -220,6 +304,13 @@ func (r *fakeOAuthServer) authHandler(cx *gin.Context) {
 	if state == "" {
 		state = "/"
 	}
+	r.Lock()
+	r.prompts = append(r.prompts, cx.Query("prompt"))
+	r.Unlock()
+	if cx.Query("prompt") == "none" && r.loginRequired {
+		cx.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?state=%s&error=login_required", redirect, state))
+		return
+	}
 	// step: generate a random authentication code
 	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, getRandomString(32))
 
@@ -250,7 +341,7 @@ func (r *fakeOAuthServer) userinfoHandler(cx *gin.Context) {
 func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 	expiration := time.Now().Add(time.Duration(1) * time.Hour)
 
-	token, err := jose.NewSignedJWT(r.claims, r.signer)
+	token, err := r.signToken(r.claims)
 	if err != nil {
 		cx.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -277,6 +368,21 @@ func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 			"error":             "invalid_grant",
 			"error_description": "Invalid user credentials",
 		})
+	case oauth2.GrantTypeRefreshToken:
+		if cx.PostForm("refresh_token") == "" {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		r.Lock()
+		r.refreshes++
+		r.Unlock()
+		time.Sleep(r.refreshDelay)
+		cx.JSON(http.StatusOK, tokenResponse{
+			IDToken:      token.Encode(),
+			AccessToken:  token.Encode(),
+			RefreshToken: token.Encode(),
+			ExpiresIn:    expiration.Second(),
+		})
 	case oauth2.GrantTypeAuthCode:
 		cx.JSON(http.StatusOK, tokenResponse{
 			IDToken:      token.Encode(),
@@ -315,7 +421,7 @@ func TestTokenExpired(t *testing.T) {
 			t.Errorf("case %d unable to sign the token, error: %s", i, err)
 			continue
 		}
-		err = verifyToken(px.client, *signed)
+		err = verifyToken(px.getClient(), *signed)
 		if x.OK && err != nil {
 			t.Errorf("case %d, expected: %t got error: %s", i, x.OK, err)
 		}
@@ -325,6 +431,112 @@ func TestTokenExpired(t *testing.T) {
 	}
 }
 
+func TestVerifyTimeClaims(t *testing.T) {
+	now := time.Now()
+	cs := []struct {
+		Claims   jose.Claims
+		Leeway   time.Duration
+		Expected error
+	}{
+		{
+			Claims: jose.Claims{"exp": float64(now.Add(time.Hour).Unix()), "iat": float64(now.Unix())},
+		},
+		{
+			Claims:   jose.Claims{"exp": float64(now.Add(-10 * time.Second).Unix()), "iat": float64(now.Unix())},
+			Expected: ErrAccessTokenExpired,
+		},
+		{
+			Claims: jose.Claims{"exp": float64(now.Add(-10 * time.Second).Unix()), "iat": float64(now.Unix())},
+			Leeway: time.Duration(30) * time.Second,
+		},
+		{
+			Claims:   jose.Claims{"exp": float64(now.Add(-time.Minute).Unix()), "iat": float64(now.Unix())},
+			Leeway:   time.Duration(30) * time.Second,
+			Expected: ErrAccessTokenExpired,
+		},
+		{
+			Claims: jose.Claims{
+				"exp": float64(now.Add(time.Hour).Unix()),
+				"iat": float64(now.Unix()),
+				"nbf": float64(now.Add(10 * time.Second).Unix()),
+			},
+			Expected: ErrAccessTokenNotValidYet,
+		},
+		{
+			Claims: jose.Claims{
+				"exp": float64(now.Add(time.Hour).Unix()),
+				"iat": float64(now.Unix()),
+				"nbf": float64(now.Add(10 * time.Second).Unix()),
+			},
+			Leeway: time.Duration(30) * time.Second,
+		},
+		{
+			Claims:   jose.Claims{"exp": float64(now.Add(time.Hour).Unix()), "iat": float64(now.Add(10 * time.Second).Unix())},
+			Expected: ErrAccessTokenIssuedInFuture,
+		},
+		{
+			Claims: jose.Claims{"exp": float64(now.Add(time.Hour).Unix()), "iat": float64(now.Add(10 * time.Second).Unix())},
+			Leeway: time.Duration(30) * time.Second,
+		},
+		{
+			Claims:   jose.Claims{"exp": float64(now.Add(time.Hour).Unix()), "iat": float64(now.Add(time.Minute).Unix())},
+			Leeway:   time.Duration(30) * time.Second,
+			Expected: ErrAccessTokenIssuedInFuture,
+		},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, verifyTimeClaims(c.Claims, c.Leeway), "case %d, expected: %v", i, c.Expected)
+	}
+	assert.Error(t, verifyTimeClaims(jose.Claims{"iat": float64(now.Unix())}, 0))
+	assert.Error(t, verifyTimeClaims(jose.Claims{"exp": float64(now.Add(time.Hour).Unix()), "iat": "bad"}, 0))
+	assert.NoError(t, verifyTimeClaims(jose.Claims{"exp": float64(now.Add(time.Hour).Unix())}, 0))
+}
+
+func TestClockSkew(t *testing.T) {
+	cs := []struct {
+		ClockSkew  time.Duration
+		Skip       bool
+		Expires    time.Duration
+		IssuedAt   time.Duration
+		NoIssuedAt bool
+		Expected   int
+	}{
+		{Expires: -10 * time.Second, Expected: http.StatusUnauthorized},
+		{ClockSkew: 30 * time.Second, Expires: -10 * time.Second, Expected: http.StatusOK},
+		{ClockSkew: 30 * time.Second, Expires: -time.Minute, Expected: http.StatusUnauthorized},
+		{Expires: time.Hour, IssuedAt: 10 * time.Second, Expected: http.StatusForbidden},
+		{ClockSkew: 30 * time.Second, Expires: time.Hour, IssuedAt: 10 * time.Second, Expected: http.StatusOK},
+		{Skip: true, Expires: -10 * time.Second, Expected: http.StatusUnauthorized},
+		{Skip: true, ClockSkew: 30 * time.Second, Expires: -10 * time.Second, Expected: http.StatusOK},
+		{Skip: true, Expires: time.Hour, IssuedAt: 10 * time.Second, Expected: http.StatusForbidden},
+		{Expires: time.Hour, NoIssuedAt: true, Expected: http.StatusOK},
+		{Skip: true, Expires: time.Hour, NoIssuedAt: true, Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		config := newFakeKeycloakConfig()
+		config.ClockSkew = c.ClockSkew
+		config.SkipTokenVerification = c.Skip
+		config.NoRedirects = true
+		_, idp, svc := newTestProxyService(config)
+
+		token := newTestToken(idp.getLocation())
+		token.setExpiration(time.Now().Add(c.Expires))
+		token.claims.Add("iat", float64(time.Now().Add(c.IssuedAt).Unix()))
+		if c.NoIssuedAt {
+			delete(token.claims, "iat")
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp, err := resty.New().R().SetAuthToken(signed.Encode()).Get(svc + fakeAuthAllURL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+	}
+}
+
 func getRandomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
@@ -0,0 +1,876 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// policyRule is a compiled rule of the embedded policy language; a small subset of the common
+// expression language over the request, claims, roles, groups and user variables, i.e.
+// 'finance' in claims.groups && request.method != 'DELETE'
+type policyRule struct {
+	// the source of the rule
+	source string
+	// the root of the syntax tree
+	root policyNode
+}
+
+// policyNode is a node of the syntax tree
+type policyNode interface {
+	eval(map[string]interface{}) (interface{}, error)
+}
+
+// compilePolicyRule parses the rule
+func compilePolicyRule(source string) (*policyRule, error) {
+	tokens, err := tokenizePolicy(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) <= 0 {
+		return nil, errors.New("the rule is empty")
+	}
+	parser := &policyParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token, found := parser.peek(); found {
+		return nil, fmt.Errorf("unexpected token: '%s' in rule", token.value)
+	}
+
+	return &policyRule{source: source, root: root}, nil
+}
+
+// evaluate evaluates the rule against the variables, the rule must produce a boolean
+func (r *policyRule) evaluate(vars map[string]interface{}) (bool, error) {
+	value, err := r.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("the rule produced a %s rather than a bool", policyTypeName(value))
+	}
+
+	return result, nil
+}
+
+// newPolicyVariables returns the variables exposed to the rules
+func newPolicyVariables(req *http.Request, params map[string]string, user *userContext) map[string]interface{} {
+	headers := make(map[string]interface{}, len(req.Header))
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = req.Header.Get(k)
+	}
+	paramValues := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		paramValues[k] = v
+	}
+
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":  req.Method,
+			"path":    req.URL.Path,
+			"host":    req.Host,
+			"headers": headers,
+			"params":  paramValues,
+		},
+		"claims": map[string]interface{}(user.claims),
+		"roles":  toPolicyList(user.roles),
+		"groups": toPolicyList(user.groups),
+		"user": map[string]interface{}{
+			"id":       user.id,
+			"username": user.name,
+			"email":    user.email,
+		},
+	}
+}
+
+func toPolicyList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, x := range values {
+		list[i] = x
+	}
+
+	return list
+}
+
+// policyToken is a token of a rule
+type policyToken struct {
+	// the kind of token, ident, string, number or op
+	kind  string
+	value string
+}
+
+// tokenizePolicy splits the rule into tokens
+func tokenizePolicy(source string) ([]policyToken, error) {
+	var tokens []policyToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			var value []rune
+			i++
+			for ; i < len(runes) && runes[i] != c; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.New("unterminated string in rule")
+			}
+			i++
+			tokens = append(tokens, policyToken{kind: "string", value: string(value)})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, policyToken{kind: "number", value: string(runes[start:i])})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, policyToken{kind: "ident", value: string(runes[start:i])})
+		default:
+			op := string(c)
+			if i+1 < len(runes) {
+				if pair := string(runes[i : i+2]); containedIn(pair, []string{"&&", "||", "==", "!=", "<=", ">="}) {
+					op = pair
+				}
+			}
+			if !containedIn(op, []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ","}) {
+				return nil, fmt.Errorf("unexpected character: '%c' in rule", c)
+			}
+			tokens = append(tokens, policyToken{kind: "op", value: op})
+			i += len(op)
+		}
+	}
+
+	return tokens, nil
+}
+
+// policyParser is a recursive descent parser over the tokens of a rule
+type policyParser struct {
+	tokens   []policyToken
+	position int
+}
+
+func (p *policyParser) peek() (policyToken, bool) {
+	if p.position >= len(p.tokens) {
+		return policyToken{}, false
+	}
+
+	return p.tokens[p.position], true
+}
+
+func (p *policyParser) next() (policyToken, bool) {
+	token, found := p.peek()
+	if found {
+		p.position++
+	}
+
+	return token, found
+}
+
+// accept consumes the token if it's the operator or keyword
+func (p *policyParser) accept(values ...string) (string, bool) {
+	token, found := p.peek()
+	if !found || token.kind == "string" || token.kind == "number" {
+		return "", false
+	}
+	if token.kind == "ident" && token.value != "in" {
+		return "", false
+	}
+	for _, x := range values {
+		if token.value == x {
+			p.position++
+			return x, true
+		}
+	}
+
+	return "", false
+}
+
+// expect consumes the operator or returns an error
+func (p *policyParser) expect(value string) error {
+	if _, found := p.accept(value); !found {
+		return fmt.Errorf("expected '%s' in rule", value)
+	}
+
+	return nil
+}
+
+func (p *policyParser) parseOr() (policyNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, found := p.accept("||"); !found {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyLogical{operator: "||", left: left, right: right}
+	}
+}
+
+func (p *policyParser) parseAnd() (policyNode, error) {
+	left, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, found := p.accept("&&"); !found {
+			return left, nil
+		}
+		right, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyLogical{operator: "&&", left: left, right: right}
+	}
+}
+
+func (p *policyParser) parseRelation() (policyNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, found := p.accept("==", "!=", "<=", ">=", "<", ">", "in")
+		if !found {
+			return left, nil
+		}
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *policyParser) parseAdditive() (policyNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, found := p.accept("+", "-")
+		if !found {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *policyParser) parseMultiplicative() (policyNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, found := p.accept("*", "/", "%")
+		if !found {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *policyParser) parseUnary() (policyNode, error) {
+	if operator, found := p.accept("!", "-"); found {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &policyUnary{operator: operator, operand: operand}, nil
+	}
+
+	return p.parseMember()
+}
+
+func (p *policyParser) parseMember() (policyNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, found := p.accept("."); found {
+			token, found := p.next()
+			if !found || token.kind != "ident" {
+				return nil, errors.New("expected a field or function after '.' in rule")
+			}
+			if _, found := p.accept("("); found {
+				args, err := p.parseArguments()
+				if err != nil {
+					return nil, err
+				}
+				if node, err = newPolicyCall(token.value, append([]policyNode{node}, args...)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			node = &policySelect{operand: node, field: token.value}
+			continue
+		}
+		if _, found := p.accept("["); found {
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &policyIndex{operand: node, index: index}
+			continue
+		}
+
+		return node, nil
+	}
+}
+
+func (p *policyParser) parsePrimary() (policyNode, error) {
+	token, found := p.next()
+	if !found {
+		return nil, errors.New("unexpected end of rule")
+	}
+	switch token.kind {
+	case "string":
+		return &policyLiteral{value: token.value}, nil
+	case "number":
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s in rule", token.value)
+		}
+		return &policyLiteral{value: number}, nil
+	case "ident":
+		switch token.value {
+		case "true", "false":
+			return &policyLiteral{value: token.value == "true"}, nil
+		case "null":
+			return &policyLiteral{}, nil
+		}
+		if _, found := p.accept("("); found {
+			args, err := p.parseArguments()
+			if err != nil {
+				return nil, err
+			}
+			return newPolicyCall(token.value, args)
+		}
+		return &policyVariable{name: token.value}, nil
+	}
+	switch token.value {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case "[":
+		list := &policyList{}
+		if _, found := p.accept("]"); found {
+			return list, nil
+		}
+		for {
+			item, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if _, found := p.accept(","); !found {
+				return list, p.expect("]")
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected token: '%s' in rule", token.value)
+}
+
+// parseArguments parses the arguments of a call, the opening parenthesis has been consumed
+func (p *policyParser) parseArguments() ([]policyNode, error) {
+	var args []policyNode
+	if _, found := p.accept(")"); found {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if _, found := p.accept(","); !found {
+			return args, p.expect(")")
+		}
+	}
+}
+
+// policyLiteral is a constant
+type policyLiteral struct {
+	value interface{}
+}
+
+func (n *policyLiteral) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+// policyVariable is a reference to a variable
+type policyVariable struct {
+	name string
+}
+
+func (n *policyVariable) eval(vars map[string]interface{}) (interface{}, error) {
+	value, found := vars[n.name]
+	if !found {
+		return nil, fmt.Errorf("undeclared reference to '%s'", n.name)
+	}
+
+	return value, nil
+}
+
+// policyList is a list of values
+type policyList struct {
+	items []policyNode
+}
+
+func (n *policyList) eval(vars map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, x := range n.items {
+		value, err := x.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+
+	return list, nil
+}
+
+// policySelect selects a field of a map
+type policySelect struct {
+	operand policyNode
+	field   string
+}
+
+func (n *policySelect) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unable to select the field '%s' of a %s", n.field, policyTypeName(value))
+	}
+	field, found := fields[n.field]
+	if !found {
+		return nil, fmt.Errorf("no such key: '%s'", n.field)
+	}
+
+	return field, nil
+}
+
+// policyIndex indexes a list or map
+type policyIndex struct {
+	operand policyNode
+	index   policyNode
+}
+
+func (n *policyIndex) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("unable to index a map with a %s", policyTypeName(index))
+		}
+		field, found := v[key]
+		if !found {
+			return nil, fmt.Errorf("no such key: '%s'", key)
+		}
+		return field, nil
+	case []interface{}:
+		number, ok := index.(float64)
+		if !ok || number != float64(int(number)) {
+			return nil, fmt.Errorf("unable to index a list with a %s", policyTypeName(index))
+		}
+		if int(number) < 0 || int(number) >= len(v) {
+			return nil, fmt.Errorf("index %d out of range", int(number))
+		}
+		return v[int(number)], nil
+	}
+
+	return nil, fmt.Errorf("unable to index a %s", policyTypeName(value))
+}
+
+// policyUnary is a negation
+type policyUnary struct {
+	operator string
+	operand  policyNode
+}
+
+func (n *policyUnary) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case bool:
+		if n.operator == "!" {
+			return !v, nil
+		}
+	case float64:
+		if n.operator == "-" {
+			return -v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no such overload: %s%s", n.operator, policyTypeName(value))
+}
+
+// policyLogical is a short circuiting && or ||
+type policyLogical struct {
+	operator    string
+	left, right policyNode
+}
+
+func (n *policyLogical) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := evalPolicyBool(n.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	if (n.operator == "&&" && !left) || (n.operator == "||" && left) {
+		return left, nil
+	}
+
+	return evalPolicyBool(n.right, vars)
+}
+
+func evalPolicyBool(node policyNode, vars map[string]interface{}) (bool, error) {
+	value, err := node.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, found a %s", policyTypeName(value))
+	}
+
+	return result, nil
+}
+
+// policyBinary is a comparison or arithmetic operation
+type policyBinary struct {
+	operator    string
+	left, right policyNode
+}
+
+func (n *policyBinary) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==":
+		return policyEqual(left, right), nil
+	case "!=":
+		return !policyEqual(left, right), nil
+	case "in":
+		switch v := right.(type) {
+		case []interface{}:
+			for _, x := range v {
+				if policyEqual(left, x) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				break
+			}
+			_, found := v[key]
+			return found, nil
+		}
+	case "+":
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+		if l, ok := left.([]interface{}); ok {
+			if r, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+		fallthrough
+	default:
+		if l, ok := left.(float64); ok {
+			if r, ok := right.(float64); ok {
+				return policyArithmetic(n.operator, l, r)
+			}
+		}
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return policyCompareStrings(n.operator, l, r)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no such overload: %s %s %s", policyTypeName(left), n.operator, policyTypeName(right))
+}
+
+func policyArithmetic(operator string, l, r float64) (interface{}, error) {
+	switch operator {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if operator == "%" {
+			return math.Mod(l, r), nil
+		}
+		return l / r, nil
+	}
+
+	return nil, fmt.Errorf("no such overload: double %s double", operator)
+}
+
+func policyCompareStrings(operator string, l, r string) (interface{}, error) {
+	switch operator {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+
+	return nil, fmt.Errorf("no such overload: string %s string", operator)
+}
+
+// policyEqual compares the values
+func policyEqual(left, right interface{}) bool {
+	return reflect.DeepEqual(left, right)
+}
+
+// policyCall is a call to a builtin function
+type policyCall struct {
+	name string
+	args []policyNode
+	// the compiled regex for matches with a literal pattern
+	regex *regexp.Regexp
+}
+
+// policyFunctions are the builtin functions and the number of arguments, including the target
+// for the method style i.e. request.path.startsWith('/api')
+var policyFunctions = map[string]int{
+	"contains":   2,
+	"endsWith":   2,
+	"has":        1,
+	"lowerAscii": 1,
+	"matches":    2,
+	"size":       1,
+	"startsWith": 2,
+}
+
+func newPolicyCall(name string, args []policyNode) (policyNode, error) {
+	count, found := policyFunctions[name]
+	if !found {
+		return nil, fmt.Errorf("undeclared function: '%s'", name)
+	}
+	if len(args) != count {
+		return nil, fmt.Errorf("the function: '%s' expects %d arguments", name, count)
+	}
+	call := &policyCall{name: name, args: args}
+	switch name {
+	case "has":
+		if _, ok := args[0].(*policySelect); !ok {
+			return nil, errors.New("the function: 'has' expects a field selection i.e. has(claims.groups)")
+		}
+	case "matches":
+		if literal, ok := args[1].(*policyLiteral); ok {
+			pattern, ok := literal.value.(string)
+			if !ok {
+				return nil, errors.New("the function: 'matches' expects a string pattern")
+			}
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex: %s, error: %s", pattern, err)
+			}
+			call.regex = regex
+		}
+	}
+
+	return call, nil
+}
+
+func (n *policyCall) eval(vars map[string]interface{}) (interface{}, error) {
+	// step: has tests for the presence of the field rather than evaluating it
+	if n.name == "has" {
+		selection := n.args[0].(*policySelect)
+		value, err := selection.operand.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unable to select the field '%s' of a %s", selection.field, policyTypeName(value))
+		}
+		_, found := fields[selection.field]
+		return found, nil
+	}
+	var args []interface{}
+	for _, x := range n.args {
+		value, err := x.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+	switch n.name {
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+	case "lowerAscii":
+		if v, ok := args[0].(string); ok {
+			return strings.ToLower(v), nil
+		}
+	case "contains":
+		if v, ok := args[0].([]interface{}); ok {
+			for _, x := range v {
+				if policyEqual(x, args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		fallthrough
+	default:
+		target, ok := args[0].(string)
+		if !ok {
+			break
+		}
+		value, ok := args[1].(string)
+		if !ok {
+			break
+		}
+		switch n.name {
+		case "contains":
+			return strings.Contains(target, value), nil
+		case "startsWith":
+			return strings.HasPrefix(target, value), nil
+		case "endsWith":
+			return strings.HasSuffix(target, value), nil
+		case "matches":
+			regex := n.regex
+			if regex == nil {
+				compiled, err := regexp.Compile(value)
+				if err != nil {
+					return nil, err
+				}
+				regex = compiled
+			}
+			return regex.MatchString(target), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no such overload: %s(%s)", n.name, policyTypeNames(args))
+}
+
+// policyTypeName returns the name of the type of the value
+func policyTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func policyTypeNames(values []interface{}) string {
+	var names []string
+	for _, x := range values {
+		names = append(names, policyTypeName(x))
+	}
+
+	return strings.Join(names, ", ")
+}
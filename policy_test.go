@@ -0,0 +1,131 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompilePolicyRule(t *testing.T) {
+	cs := []struct {
+		Rule string
+		Ok   bool
+	}{
+		{Rule: "'finance' in claims.groups && request.method != 'DELETE'", Ok: true},
+		{Rule: "!('admin' in roles) || request.path.startsWith('/api/')", Ok: true},
+		{Rule: "has(claims.tenant) && claims['tenant'] == \"acme\"", Ok: true},
+		{Rule: "size(groups) > 1 && claims.level >= 2 * 3", Ok: true},
+		{Rule: "request.headers['x-tenant'].matches('^acme-[a-z]+$')", Ok: true},
+		{Rule: "request.method in ['GET', 'HEAD']", Ok: true},
+		{Rule: "true", Ok: true},
+		{Rule: ""},
+		{Rule: "request.method =="},
+		{Rule: "request.method = 'GET'"},
+		{Rule: "'finance"},
+		{Rule: "(true"},
+		{Rule: "['a', 'b'"},
+		{Rule: "true true"},
+		{Rule: "unknown(roles)"},
+		{Rule: "roles.size(1)"},
+		{Rule: "has(roles)"},
+		{Rule: "request.path.matches('[')"},
+		{Rule: "request.path # 1"},
+	}
+	for i, c := range cs {
+		_, err := compilePolicyRule(c.Rule)
+		if c.Ok && err != nil {
+			t.Errorf("case %d, rule: %s should not have failed, error: %s", i, c.Rule, err)
+		}
+		if !c.Ok && err == nil {
+			t.Errorf("case %d, rule: %s should have failed", i, c.Rule)
+		}
+	}
+}
+
+func TestPolicyRuleEvaluate(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/api/reports/42", nil)
+	req.Header.Set("X-Tenant", "acme-dev")
+	user := &userContext{
+		id:     "1234",
+		name:   "gambol",
+		email:  "gambol@example.com",
+		roles:  []string{"admin", "reader"},
+		groups: []string{"/org/finance", "finance"},
+		claims: jose.Claims{
+			"groups": []interface{}{"finance", "ops"},
+			"level":  float64(4),
+			"ratio":  float64(0.5),
+			"tenant": "acme",
+			"address": map[string]interface{}{
+				"country": "GB",
+			},
+		},
+	}
+	vars := newPolicyVariables(req, map[string]string{"id": "42"}, user)
+	cs := []struct {
+		Rule     string
+		Expected bool
+		Error    bool
+	}{
+		{Rule: "'finance' in claims.groups && request.method != 'DELETE'", Expected: true},
+		{Rule: "'sales' in claims.groups", Expected: false},
+		{Rule: "'admin' in roles && '/org/finance' in groups", Expected: true},
+		{Rule: "request.path.startsWith('/api/') && request.path.endsWith('/42')", Expected: true},
+		{Rule: "request.params.id == '42'", Expected: true},
+		{Rule: "request.host == '127.0.0.1'", Expected: true},
+		{Rule: "request.headers['x-tenant'].matches('^acme-[a-z]+$')", Expected: true},
+		{Rule: "request.method in ['POST', 'PUT']", Expected: false},
+		{Rule: "claims.level >= 3 && claims.level + 1 == 5", Expected: true},
+		{Rule: "claims.address.country == 'GB'", Expected: true},
+		{Rule: "'country' in claims.address", Expected: true},
+		{Rule: "has(claims.tenant) && !has(claims.missing)", Expected: true},
+		{Rule: "size(roles) == 2 && roles.size() == 2", Expected: true},
+		{Rule: "roles.contains('reader') && user.email.contains('@example')", Expected: true},
+		{Rule: "user.username.lowerAscii() == 'gambol' && user.id == '1234'", Expected: true},
+		{Rule: "claims.groups[1] == 'ops'", Expected: true},
+		{Rule: "false && claims.missing == 'x'", Expected: false},
+		{Rule: "true || claims.missing == 'x'", Expected: true},
+		{Rule: "claims.missing == 'x'", Error: true},
+		{Rule: "claims.tenant > 1", Error: true},
+		{Rule: "claims.tenant", Error: true},
+		{Rule: "claims.level && true", Error: true},
+		{Rule: "claims.groups[5] == 'x'", Error: true},
+		{Rule: "claims.level / 0 == 1", Error: true},
+		{Rule: "claims.level % 3 == 1", Expected: true},
+		{Rule: "claims.level % claims.ratio == 0", Expected: true},
+		{Rule: "claims.level % 0 == 1", Error: true},
+		{Rule: "unknown == 1", Error: true},
+	}
+	for i, c := range cs {
+		rule, err := compilePolicyRule(c.Rule)
+		if !assert.NoError(t, err, "case %d, rule: %s", i, c.Rule) {
+			continue
+		}
+		allowed, err := rule.evaluate(vars)
+		if c.Error {
+			assert.Error(t, err, "case %d, rule: %s should have failed", i, c.Rule)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d, rule: %s", i, c.Rule) {
+			continue
+		}
+		assert.Equal(t, c.Expected, allowed, "case %d, rule: %s", i, c.Rule)
+	}
+}
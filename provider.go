@@ -0,0 +1,217 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+var (
+	// providerRetryInterval is the initial interval between attempts to discover the provider
+	providerRetryInterval = time.Duration(3) * time.Second
+	// providerRetryMaxInterval is the maximum interval between attempts to discover the provider
+	providerRetryMaxInterval = time.Duration(60) * time.Second
+)
+
+// providerState holds the openid provider and the state of the discovery
+type providerState struct {
+	sync.RWMutex
+	// the opened client
+	client *oidc.Client
+	// the openid provider configuration
+	idp oidc.ProviderConfig
+	// the provider http client
+	idpClient *http.Client
+	// the number of attempts at discovery
+	attempts int
+	// the last error from discovery
+	lastError string
+	// the time the provider was discovered
+	updated time.Time
+}
+
+// providerStatus is the readiness of the proxy
+type providerStatus struct {
+	// Ready indicates the proxy is able to verify tokens
+	Ready bool `json:"ready"`
+	// Discovery is the state of the discovery, ready, pending or disabled
+	Discovery string `json:"discovery"`
+	// Issuer is the issuer of the provider
+	Issuer string `json:"issuer,omitempty"`
+	// Attempts is the number of discovery attempts
+	Attempts int `json:"attempts"`
+	// LastError is the last discovery error
+	LastError string `json:"last_error,omitempty"`
+	// Keys is the number of keys available to verify the tokens
+	Keys int `json:"keys"`
+	// KeysSource is where the keys came from, discovery or files
+	KeysSource string `json:"keys_source,omitempty"`
+	// Updated is the time the provider was discovered
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// getClient returns the openid client, nil if the provider is not known
+func (r *oauthProxy) getClient() *oidc.Client {
+	r.provider.RLock()
+	defer r.provider.RUnlock()
+
+	return r.provider.client
+}
+
+// getIDP returns the openid provider configuration
+func (r *oauthProxy) getIDP() oidc.ProviderConfig {
+	r.provider.RLock()
+	defer r.provider.RUnlock()
+
+	return r.provider.idp
+}
+
+// getIDPClient returns the http client for the provider
+func (r *oauthProxy) getIDPClient() *http.Client {
+	r.provider.RLock()
+	defer r.provider.RUnlock()
+
+	return r.provider.idpClient
+}
+
+// setProvider updates the openid provider
+func (r *oauthProxy) setProvider(client *oidc.Client, idp oidc.ProviderConfig, hc *http.Client) {
+	r.provider.Lock()
+	defer r.provider.Unlock()
+
+	r.provider.client = client
+	r.provider.idp = idp
+	r.provider.idpClient = hc
+	r.provider.updated = time.Now()
+}
+
+// hasProvider checks if we have a openid provider, we can run without one verifying tokens with local keys
+func (r *oauthProxy) hasProvider() bool {
+	return r.getClient() != nil
+}
+
+// isProviderPending checks if the provider is configured but has not yet been discovered
+func (r *oauthProxy) isProviderPending() bool {
+	return r.config.DiscoveryURL != "" && !r.hasProvider()
+}
+
+// getVerifier returns the verifier for the tokens, the local public keys take precedence over the
+// provider keys, nil if we are unable to verify tokens. Note, the openid client is not used as a
+// verifier, it checks the expiration without the leeway; the provider is only set once its keys
+// have been retrieved, so the keys are always available to verify with
+func (r *oauthProxy) getVerifier() tokenVerifier {
+	if r.keys != nil {
+		return r.keys
+	}
+	if r.jwks != nil && r.jwks.hasKeys() {
+		return r.jwks
+	}
+
+	return nil
+}
+
+// discoverProvider attempts to retrieve the provider configuration and keys
+func (r *oauthProxy) discoverProvider() error {
+	client, idp, hc, err := newOpenIDClient(r.config)
+	if err == nil {
+		// step: ensure we can retrieve the keys for the realm
+		r.jwks.setProvider(idp.Issuer.String(), idp.KeysEndpoint.String(), hc)
+		err = r.jwks.refresh(true)
+	}
+
+	r.provider.Lock()
+	r.provider.attempts++
+	r.provider.lastError = ""
+	if err != nil {
+		r.provider.lastError = err.Error()
+	}
+	r.provider.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.setProvider(client, idp, hc)
+	r.jwks.watch()
+	// step: start the provider sync for key rotation, only once the client is in use, as a
+	// failed attempt would otherwise leave the sync of a discarded client running
+	client.SyncProviderConfig(r.config.DiscoveryURL)
+
+	return nil
+}
+
+// retryProviderDiscovery attempts to discover the provider in the background with a backoff
+func (r *oauthProxy) retryProviderDiscovery() {
+	interval := providerRetryInterval
+	for {
+		time.Sleep(interval)
+		if err := r.discoverProvider(); err != nil {
+			log.WithFields(log.Fields{
+				"discovery_url": r.config.DiscoveryURL,
+				"error":         err.Error(),
+				"retry_in":      interval.String(),
+			}).Warnf("failed to retrieve the provider configuration")
+
+			if interval *= 2; interval > providerRetryMaxInterval {
+				interval = providerRetryMaxInterval
+			}
+			continue
+		}
+		log.Infof("successfully retrieved the openid configuration from the discovery url: %s", r.config.DiscoveryURL)
+
+		return
+	}
+}
+
+// getProviderStatus returns the readiness of the proxy
+func (r *oauthProxy) getProviderStatus() providerStatus {
+	r.provider.RLock()
+	defer r.provider.RUnlock()
+
+	status := providerStatus{
+		Discovery: "disabled",
+		Attempts:  r.provider.attempts,
+		LastError: r.provider.lastError,
+	}
+	if r.config.DiscoveryURL != "" {
+		status.Discovery = "pending"
+		if r.provider.client != nil {
+			updated := r.provider.updated
+			status.Discovery = "ready"
+			status.Issuer = r.provider.idp.Issuer.String()
+			status.Updated = &updated
+		}
+	}
+	if r.jwks != nil && r.jwks.hasKeys() {
+		status.Keys = len(r.jwks.getKeys())
+		status.KeysSource = "discovery"
+		if r.jwks.isCached() {
+			status.KeysSource = "cache"
+		}
+	}
+	if r.keys != nil {
+		status.Keys = len(r.keys.getKeys())
+		status.KeysSource = "files"
+	}
+	// step: we can serve bearer tokens from the cached keys while the provider is unavailable
+	status.Ready = status.Keys > 0 && (status.Discovery != "pending" || status.KeysSource != "discovery")
+
+	return status
+}
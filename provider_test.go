@@ -0,0 +1,127 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderDiscoveryRetry(t *testing.T) {
+	interval := providerRetryInterval
+	providerRetryInterval = time.Duration(10) * time.Millisecond
+	defer func() { providerRetryInterval = interval }()
+
+	idp := newFakeOAuthServer().setDiscoveryDown(true)
+	config := newFakeKeycloakConfig()
+	config.DiscoveryURL = idp.getLocation()
+	proxy, err := newProxy(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy.upstream = new(testReverseProxy)
+	svc := httptest.NewServer(proxy.router)
+
+	// step: until the provider is discovered we should be unavailable
+	cs := []struct {
+		URL      string
+		Expected int
+	}{
+		{URL: oauthURL + readyURL, Expected: http.StatusServiceUnavailable},
+		{URL: fakeAdminRoleURL, Expected: http.StatusServiceUnavailable},
+		{URL: oauthURL + authorizationURL, Expected: http.StatusServiceUnavailable},
+		{URL: oauthURL + healthURL, Expected: http.StatusOK},
+		{URL: fakeTestWhitelistedURL, Expected: http.StatusOK},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", svc.URL+c.URL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d, expected: %d", i, c.Expected)
+	}
+
+	// step: bring the provider up and wait for the discovery
+	idp.setDiscoveryDown(false)
+	var status providerStatus
+	for i := 0; i < 100; i++ {
+		if status = proxy.getProviderStatus(); status.Ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, status.Ready)
+	assert.Equal(t, "ready", status.Discovery)
+	assert.Equal(t, 1, status.Keys)
+	assert.True(t, status.Attempts > 1)
+
+	resp, err := http.Get(svc.URL + oauthURL + readyURL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		content, _ := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, json.Unmarshal(content, &status))
+		assert.Equal(t, "discovery", status.KeysSource)
+	}
+	req, _ := http.NewRequest("GET", svc.URL+fakeAdminRoleURL, nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+}
+
+func TestProviderStatusOffline(t *testing.T) {
+	idp := newFakeOAuthServer()
+	dir, jwksFile, _ := newTestKeyFiles(t, idp)
+	defer os.RemoveAll(dir)
+
+	proxy := &oauthProxy{config: &Config{}}
+	status := proxy.getProviderStatus()
+	assert.False(t, status.Ready)
+	assert.Equal(t, "disabled", status.Discovery)
+
+	proxy.keys, _ = newKeySetVerifier([]string{jwksFile}, idp.getLocation(), "test", 0)
+	status = proxy.getProviderStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, "files", status.KeysSource)
+	assert.Equal(t, 1, status.Keys)
+}
+
+func TestForwardProxyHandlerPending(t *testing.T) {
+	proxy := &oauthProxy{config: &Config{
+		DiscoveryURL:      "http://127.0.0.1:1",
+		ForwardingDomains: []string{"example.com"},
+	}}
+	handler := proxy.forwardProxyHandler()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	resp := handler(req)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	// step: the domains which are not signed should be relayed
+	req, _ = http.NewRequest(http.MethodGet, "http://other.com/", nil)
+	assert.Nil(t, handler(req))
+}
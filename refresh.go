@@ -0,0 +1,192 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+// refreshResultTTL is the time the result of a refresh is kept, so a request arriving shortly
+// after with the same refresh token reuses it rather than re-granting a rotated refresh token
+var refreshResultTTL = time.Duration(10) * time.Second
+
+// refreshCall is a in-flight or completed refresh of an access token
+type refreshCall struct {
+	sync.WaitGroup
+	// the refreshed access token
+	token jose.JWT
+	// the refresh token issued with the access token, if any
+	refresh string
+	// the error from the refresh, if any
+	err error
+}
+
+// refreshGroup coalesces concurrent refreshes of the same refresh token, ensuring
+// only a single grant is made to the provider and the result shared with the others
+type refreshGroup struct {
+	sync.Mutex
+	// calls is a map of refresh token to the in-flight or recently completed refresh
+	calls map[string]*refreshCall
+	// ttl is the time a successful refresh is kept
+	ttl time.Duration
+}
+
+// newRefreshGroup creates a new refresh group
+func newRefreshGroup() *refreshGroup {
+	return &refreshGroup{
+		calls: make(map[string]*refreshCall, 0),
+		ttl:   refreshResultTTL,
+	}
+}
+
+// do performs the refresh for the refresh token, if a refresh is in-flight or completed within the
+// ttl the caller waits for and returns its result. The shared flag indicates the result came from
+// another caller; failed refreshes are not kept, permitting a retry
+func (g *refreshGroup) do(refresh string, fn func() (jose.JWT, string, error)) (jose.JWT, string, bool, error) {
+	g.Lock()
+	if call, found := g.calls[refresh]; found {
+		g.Unlock()
+		call.Wait()
+
+		return call.token, call.refresh, true, call.err
+	}
+	call := new(refreshCall)
+	call.Add(1)
+	g.calls[refresh] = call
+	g.Unlock()
+
+	call.token, call.refresh, call.err = fn()
+	call.Done()
+
+	if call.err != nil || g.ttl <= 0 {
+		g.forget(refresh, call)
+	} else {
+		time.AfterFunc(g.ttl, func() { g.forget(refresh, call) })
+	}
+
+	return call.token, call.refresh, false, call.err
+}
+
+// forget removes the call for the refresh token
+func (g *refreshGroup) forget(refresh string, call *refreshCall) {
+	g.Lock()
+	defer g.Unlock()
+	if g.calls[refresh] == call {
+		delete(g.calls, refresh)
+	}
+}
+
+// refreshAccessToken retrieves a new access token using the refresh token, concurrent requests for the
+// same refresh token share a single grant and the store is only updated by the request performing it.
+// The refresh token is returned when rotated by the provider, otherwise empty
+func (r *oauthProxy) refreshAccessToken(user *userContext, refresh string) (jose.JWT, string, error) {
+	token, rotated, shared, err := r.refreshes.do(refresh, func() (jose.JWT, string, error) {
+		token, rotated, _, err := getRefreshedToken(r.getClient(), refresh)
+		if err != nil {
+			return token, "", err
+		}
+		if rotated == refresh {
+			rotated = ""
+		}
+
+		if r.useStore() {
+			// step: the store holds the encrypted refresh token, keyed by the access token
+			state := rotated
+			if state == "" {
+				state = refresh
+			}
+			encrypted, err := encodeText(state, r.config.EncryptionKey)
+			if err != nil {
+				return token, "", err
+			}
+			go func(old, new jose.JWT, state string) {
+				if err := r.DeleteRefreshToken(old); err != nil {
+					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to remove old token")
+				}
+				if err := r.StoreRefreshToken(new, state); err != nil {
+					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to store refresh token")
+					return
+				}
+			}(user.token, token, encrypted)
+		}
+
+		return token, rotated, nil
+	})
+	if shared {
+		log.WithFields(log.Fields{
+			"email": user.email,
+		}).Debugf("reusing the access token from a concurrent refresh")
+	}
+
+	return token, rotated, err
+}
+
+// injectRefreshedToken drops the refreshed access token into the session and updates the user context,
+// a refresh token rotated by the provider replaces the one in the cookie
+func (r *oauthProxy) injectRefreshedToken(cx *gin.Context, user *userContext, token jose.JWT, refresh, rotated string) {
+	if rotated != "" {
+		refresh = rotated
+	}
+	// get the expiration of the new access token
+	expiresIn := r.getAccessCookieExpiration(token, refresh)
+
+	log.WithFields(log.Fields{
+		"client_ip":   cx.ClientIP(),
+		"cookie_name": r.config.CookieAccessName,
+		"email":       user.email,
+		"expires_in":  expiresIn.String(),
+	}).Infof("injecting the refreshed access token cookie")
+
+	// step: inject the refreshed access token
+	r.dropAccessTokenCookie(cx, token.Encode(), expiresIn)
+
+	// step: inject the rotated refresh token, the store is updated by the refresh itself
+	if rotated != "" && !r.useStore() {
+		encrypted, err := encodeText(rotated, r.config.EncryptionKey)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to encrypt the refresh token")
+		} else if _, ident, err := parseToken(rotated); err != nil {
+			r.dropRefreshTokenCookie(cx, encrypted, time.Duration(240)*time.Hour)
+		} else {
+			r.dropRefreshTokenCookie(cx, encrypted, ident.ExpiresAt.Sub(time.Now()))
+		}
+	}
+
+	// step: update the with the new access token
+	user.token = token
+
+	// step: inject the user into the context
+	cx.Set(userContextName, user)
+}
+
+// isWithinRefreshWindow checks if the access token is close enough to expiry to be refreshed, the window
+// is either a fixed duration or a percentage of the token lifetime
+func isWithinRefreshWindow(user *userContext, window time.Duration, percent float64) bool {
+	if percent > 0 {
+		if user.issuedAt.IsZero() {
+			return false
+		}
+		// step: the window is the percentage of the lifetime of the token
+		window = getWithin(time.Now().Add(user.expiresAt.Sub(user.issuedAt)), percent)
+	}
+
+	return window > 0 && user.expiresAt.Sub(time.Now()) < window
+}
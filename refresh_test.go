@@ -0,0 +1,261 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeRefreshSession creates a access token signed by the provider and an encrypted refresh token
+func newFakeRefreshSession(t *testing.T, idp *fakeOAuthServer, config *Config, expires time.Time) (string, string) {
+	claims := jose.Claims{}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	claims.Add("iat", float64(expires.Add(-1*time.Hour).Unix()))
+	claims.Add("exp", float64(expires.Unix()))
+	token, err := idp.signToken(claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	refresh, err := encodeText("refresh_token", config.EncryptionKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return token.Encode(), refresh
+}
+
+func TestRefreshGroup(t *testing.T) {
+	group := newRefreshGroup()
+	release := make(chan struct{})
+	calls := 0
+	var counter sync.Mutex
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, shared, err := group.do("refresh", func() (jose.JWT, string, error) {
+				counter.Lock()
+				calls++
+				counter.Unlock()
+				<-release
+				return jose.JWT{}, "", errors.New("failed")
+			})
+			assert.Error(t, err)
+			results <- shared
+		}()
+	}
+	// step: wait for the callers to queue up behind the leader
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	leaders := 0
+	for shared := range results {
+		if !shared {
+			leaders++
+		}
+	}
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, leaders)
+	assert.Empty(t, group.calls)
+}
+
+func TestRefreshGroupKeepsResult(t *testing.T) {
+	group := newRefreshGroup()
+	group.ttl = 100 * time.Millisecond
+	calls := 0
+	fn := func() (jose.JWT, string, error) {
+		calls++
+		return jose.JWT{}, "rotated", nil
+	}
+
+	// step: a request arriving after the refresh should reuse the result
+	_, rotated, shared, err := group.do("refresh", fn)
+	assert.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, "rotated", rotated)
+	_, rotated, shared, err = group.do("refresh", fn)
+	assert.NoError(t, err)
+	assert.True(t, shared)
+	assert.Equal(t, "rotated", rotated)
+	assert.Equal(t, 1, calls)
+
+	// step: once the ttl has passed the result should be forgotten
+	time.Sleep(200 * time.Millisecond)
+	group.Lock()
+	assert.Empty(t, group.calls)
+	group.Unlock()
+	_, _, shared, _ = group.do("refresh", fn)
+	assert.False(t, shared)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRefreshRotation(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableRefreshTokens = true
+	_, idp, u := newTestProxyService(config)
+	expired, refresh := newFakeRefreshSession(t, idp, config, time.Now().Add(-1*time.Hour))
+
+	// step: sequential requests with the same old refresh token should share the single grant
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL+"/test", nil)
+		req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: expired})
+		req.AddCookie(&http.Cookie{Name: config.CookieRefreshName, Value: refresh})
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+
+		// step: the rotated refresh token should replace the one in the cookie
+		var rotated string
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == config.CookieRefreshName {
+				rotated = cookie.Value
+			}
+		}
+		if assert.NotEmpty(t, rotated, "case %d, expected a refresh token cookie", i) {
+			decoded, err := decodeText(rotated, config.EncryptionKey)
+			assert.NoError(t, err, "case %d", i)
+			assert.NotEqual(t, "refresh_token", decoded, "case %d", i)
+		}
+	}
+	assert.Equal(t, 1, idp.getRefreshes())
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableRefreshTokens = true
+	_, idp, u := newTestProxyService(config)
+	idp.setRefreshDelay(100 * time.Millisecond)
+
+	expired, refresh := newFakeRefreshSession(t, idp, config, time.Now().Add(-1*time.Hour))
+
+	requests := 30
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", u+fakeAuthAllURL+"/test", nil)
+			req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: expired})
+			req.AddCookie(&http.Cookie{Name: config.CookieRefreshName, Value: refresh})
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, 1, idp.getRefreshes())
+}
+
+func TestIsWithinRefreshWindow(t *testing.T) {
+	cs := []struct {
+		User     *userContext
+		Window   time.Duration
+		Percent  float64
+		Expected bool
+	}{
+		{
+			User:     &userContext{expiresAt: time.Now().Add(time.Minute)},
+			Window:   5 * time.Minute,
+			Expected: true,
+		},
+		{
+			User:   &userContext{expiresAt: time.Now().Add(10 * time.Minute)},
+			Window: 5 * time.Minute,
+		},
+		{
+			User: &userContext{expiresAt: time.Now().Add(time.Minute)},
+		},
+		{
+			User:     &userContext{issuedAt: time.Now().Add(-50 * time.Minute), expiresAt: time.Now().Add(10 * time.Minute)},
+			Percent:  0.2,
+			Expected: true,
+		},
+		{
+			User:    &userContext{issuedAt: time.Now().Add(-10 * time.Minute), expiresAt: time.Now().Add(50 * time.Minute)},
+			Percent: 0.2,
+		},
+		{
+			User:    &userContext{expiresAt: time.Now().Add(time.Minute)},
+			Percent: 0.2,
+		},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, isWithinRefreshWindow(c.User, c.Window, c.Percent), "case %d, expected: %t", i, c.Expected)
+	}
+}
+
+func TestProactiveRefresh(t *testing.T) {
+	cs := []struct {
+		Expires   time.Duration
+		Refreshed bool
+	}{
+		{
+			Expires:   time.Minute,
+			Refreshed: true,
+		},
+		{
+			Expires: time.Hour,
+		},
+	}
+	for i, c := range cs {
+		config := newFakeKeycloakConfig()
+		config.EnableRefreshTokens = true
+		config.RefreshWindow = "5m"
+		_, idp, u := newTestProxyService(config)
+		access, refresh := newFakeRefreshSession(t, idp, config, time.Now().Add(c.Expires))
+
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL+"/test", nil)
+		req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: access})
+		req.AddCookie(&http.Cookie{Name: config.CookieRefreshName, Value: refresh})
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d, expected: %d", i, http.StatusOK)
+		refreshed := false
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == config.CookieAccessName {
+				refreshed = true
+			}
+		}
+		assert.Equal(t, c.Refreshed, refreshed, "case %d, expected refreshed: %t", i, c.Refreshed)
+		assert.Equal(t, c.Refreshed, idp.getRefreshes() == 1, "case %d, expected refreshed: %t", i, c.Refreshed)
+	}
+}
@@ -18,24 +18,68 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
 )
 
+// resourceOptions are the keys of the resource options
+var resourceOptions = []string{
+	"uri", "roles", "method-roles", "groups", "match", "expression", "when", "claim", "bind", "methods",
+	"cors-origins", "cors-methods", "cors-headers", "cors-credentials", "allowed-cidrs", "denied-cidrs",
+	"csrf-exempt", "deny", "report-only", "white-listed", "acr", "max-age",
+}
+
+// resourcePatternOptions are the options whose values may contain a |, i.e. a || in a rule or an
+// alternation in a regex
+var resourcePatternOptions = []string{"uri", "expression", "when", "claim"}
+
 func newResource() *Resource {
 	return &Resource{}
 }
 
+// splitResourceOptions splits the resource definition into options; a | is only treated as a separator
+// when followed by a known option, or when the value before it cannot contain one
+func splitResourceOptions(resource string) []string {
+	var options []string
+	for _, x := range strings.Split(resource, "|") {
+		if len(options) > 0 && !isResourceOption(x) {
+			last := options[len(options)-1]
+			if containedIn(strings.SplitN(last, "=", 2)[0], resourcePatternOptions) {
+				options[len(options)-1] = last + "|" + x
+				continue
+			}
+		}
+		options = append(options, x)
+	}
+
+	return options
+}
+
+// isResourceOption checks if the value starts with a known option
+func isResourceOption(value string) bool {
+	for _, x := range resourceOptions {
+		if strings.HasPrefix(value, x+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
 // parse decodes a resource definition
 func (r *Resource) parse(resource string) (*Resource, error) {
 	if resource == "" {
 		return nil, errors.New("the resource has no options")
 	}
 
-	for _, x := range strings.Split(resource, "|") {
-		kp := strings.Split(x, "=")
+	for _, x := range splitResourceOptions(resource) {
+		kp := strings.SplitN(x, "=", 2)
 		if len(kp) != 2 {
-			return nil, errors.New("invalid resource keypair, should be (uri|roles|methods|white-listed)=comma_values")
+			return nil, errors.New("invalid resource keypair, should be (uri|roles|method-roles|groups|match|expression|when|claim|bind|methods|cors-origins|cors-methods|cors-headers|cors-credentials|allowed-cidrs|denied-cidrs|csrf-exempt|deny|report-only|white-listed|acr|max-age)=comma_values")
 		}
 		switch kp[0] {
 		case "uri":
@@ -44,14 +88,97 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			r.Methods = strings.Split(kp[1], ",")
 		case "roles":
 			r.Roles = strings.Split(kp[1], ",")
+		case "method-roles":
+			roles := strings.SplitN(kp[1], "=", 2)
+			if len(roles) != 2 || roles[0] == "" || roles[1] == "" {
+				return nil, errors.New("the value of method-roles must be in the form METHOD=ROLES, i.e. POST=writer,admin")
+			}
+			if r.MethodRoles == nil {
+				r.MethodRoles = make(map[string][]string)
+			}
+			r.MethodRoles[roles[0]] = strings.Split(roles[1], ",")
+		case "groups":
+			r.Groups = strings.Split(kp[1], ",")
+		case "match":
+			r.Match = kp[1]
+		case "expression":
+			r.Expression = kp[1]
+		case "when":
+			r.When = kp[1]
+		case "claim":
+			claim := strings.SplitN(kp[1], "=", 2)
+			if len(claim) != 2 || claim[0] == "" {
+				return nil, errors.New("the value of claim must be in the form NAME=MATCHER, i.e. tenant=finance")
+			}
+			if r.Claims == nil {
+				r.Claims = make(map[string]string)
+			}
+			r.Claims[claim[0]] = claim[1]
+		case "bind":
+			binding := strings.SplitN(kp[1], "=", 2)
+			if len(binding) != 2 || binding[0] == "" || binding[1] == "" {
+				return nil, errors.New("the value of bind must be in the form PARAMETER=CLAIM, i.e. id=sub")
+			}
+			if r.Bindings == nil {
+				r.Bindings = make(map[string]string)
+			}
+			r.Bindings[binding[0]] = binding[1]
+		case "cors-origins", "cors-methods", "cors-headers", "cors-credentials":
+			if r.Cors == nil {
+				r.Cors = &Cors{}
+			}
+			switch kp[0] {
+			case "cors-origins":
+				r.Cors.Origins = strings.Split(kp[1], ",")
+			case "cors-methods":
+				r.Cors.Methods = strings.Split(kp[1], ",")
+			case "cors-headers":
+				r.Cors.Headers = strings.Split(kp[1], ",")
+			default:
+				value, err := strconv.ParseBool(kp[1])
+				if err != nil {
+					return nil, errors.New("the value of cors-credentials must be true|TRUE|T or it's false equivalent")
+				}
+				r.Cors.Credentials = value
+			}
+		case "allowed-cidrs":
+			r.AllowedCIDRs = strings.Split(kp[1], ",")
+		case "denied-cidrs":
+			r.DeniedCIDRs = strings.Split(kp[1], ",")
+		case "csrf-exempt":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of csrf-exempt must be true|TRUE|T or it's false equivalent")
+			}
+			r.CSRFExempt = value
+		case "deny":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of deny must be true|TRUE|T or it's false equivalent")
+			}
+			r.Deny = value
+		case "report-only":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of report-only must be true|TRUE|T or it's false equivalent")
+			}
+			r.ReportOnly = value
 		case "white-listed":
 			value, err := strconv.ParseBool(kp[1])
 			if err != nil {
 				return nil, errors.New("the value of whitelisted must be true|TRUE|T or it's false equivalent")
 			}
 			r.WhiteListed = value
+		case "acr":
+			r.ACR = kp[1]
+		case "max-age":
+			value, err := time.ParseDuration(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of max-age must be a duration, i.e. 10m")
+			}
+			r.MaxAge = value
 		default:
-			return nil, errors.New("invalid identifier, should be roles, uri or methods")
+			return nil, errors.New("invalid identifier, should be roles, method-roles, groups, match, expression, when, claim, bind, uri, methods, cors-origins, cors-methods, cors-headers, cors-credentials, allowed-cidrs, denied-cidrs, csrf-exempt, deny, report-only, white-listed, acr or max-age")
 		}
 	}
 
@@ -66,6 +193,9 @@ func (r *Resource) valid() error {
 	if r.Roles == nil {
 		r.Roles = make([]string, 0)
 	}
+	if r.Groups == nil {
+		r.Groups = make([]string, 0)
+	}
 
 	if strings.HasPrefix(r.URL, oauthURL) {
 		return errors.New("this is used by the oauth handlers")
@@ -76,6 +206,22 @@ func (r *Resource) valid() error {
 		return errors.New("resource does not have url")
 	}
 
+	// step: check the url is a valid pattern
+	pattern, err := compileResourcePattern(r.URL)
+	if err != nil {
+		return err
+	}
+
+	// step: check the bindings refer to parameters of the url
+	for name, claim := range r.Bindings {
+		if !containedIn(name, pattern.getParams()) {
+			return fmt.Errorf("the binding: %s=%s refers to an unknown path parameter", name, claim)
+		}
+		if claim == "" {
+			return fmt.Errorf("the binding for the path parameter: %s has no claim", name)
+		}
+	}
+
 	// step: add any of no methods
 	if len(r.Methods) <= 0 {
 		r.Methods = append(r.Methods, "ANY")
@@ -88,6 +234,54 @@ func (r *Resource) valid() error {
 		}
 	}
 
+	// step: check the method roles, the methods are normalized to upper case
+	methodRoles := make(map[string][]string, len(r.MethodRoles))
+	for method, roles := range r.MethodRoles {
+		method = strings.ToUpper(method)
+		if !isValidHTTPMethod(method) || method == "ANY" {
+			return fmt.Errorf("invalid method %s in the method roles", method)
+		}
+		if len(roles) <= 0 {
+			return fmt.Errorf("the method roles for %s has no roles", method)
+		}
+		methodRoles[method] = roles
+	}
+	if r.MethodRoles != nil {
+		r.MethodRoles = methodRoles
+	}
+
+	// step: a deny resource applies to everyone
+	if r.Deny {
+		if r.WhiteListed {
+			return errors.New("a deny resource cannot be white-listed")
+		}
+		if len(r.Roles) > 0 || len(r.Groups) > 0 || len(r.MethodRoles) > 0 {
+			return errors.New("a deny resource applies to everyone and cannot have roles or groups")
+		}
+	}
+
+	for _, x := range r.Groups {
+		if x == "" || x == "/" {
+			return errors.New("the resource has an empty group")
+		}
+	}
+
+	switch r.Match {
+	case "":
+		r.Match = matchAll
+	case matchAll, matchAny:
+	default:
+		return fmt.Errorf("invalid match: %s, should be all or any", r.Match)
+	}
+
+	if err := r.compile(); err != nil {
+		return err
+	}
+
+	if r.MaxAge < 0 {
+		return errors.New("the max-age must be a positive duration")
+	}
+
 	return nil
 }
 
@@ -96,11 +290,127 @@ func (r Resource) getRoles() string {
 	return strings.Join(r.Roles, ",")
 }
 
+// compile parses the expression, rule and claim matchers of the resource
+func (r *Resource) compile() error {
+	if r.Expression != "" {
+		expr, err := parseExpression(r.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression: %s, error: %s", r.Expression, err)
+		}
+		r.expression = expr
+	}
+	if r.When != "" {
+		rule, err := compilePolicyRule(r.When)
+		if err != nil {
+			return fmt.Errorf("invalid rule: %s, error: %s", r.When, err)
+		}
+		r.rule = rule
+	}
+	networks, err := newNetworkPolicy(r.AllowedCIDRs, r.DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	r.networks = networks
+	if r.Cors != nil {
+		if r.cors, err = newCorsPolicy(*r.Cors); err != nil {
+			return err
+		}
+	}
+	r.claimMatchers = make(map[string]*claimMatcher, len(r.Claims))
+	for name, value := range r.Claims {
+		matcher, err := parseClaimMatcher(value)
+		if err != nil {
+			return fmt.Errorf("invalid matcher: %s for claim: %s, error: %s", value, name, err)
+		}
+		r.claimMatchers[name] = matcher
+	}
+
+	return nil
+}
+
+// isCompiled checks if the resource has been compiled
+func (r *Resource) isCompiled() bool {
+	return r.claimMatchers != nil
+}
+
+// hasBindings checks the path parameters are bound to the claims of the user, returning the
+// parameter which failed
+func (r Resource) hasBindings(params map[string]string, claims jose.Claims) (string, bool) {
+	for name, claim := range r.Bindings {
+		value, found := params[name]
+		if !found || !containedIn(value, getClaimValues(claims, claim)) {
+			return name, false
+		}
+	}
+
+	return "", true
+}
+
+// hasRoles checks the user has the roles required by the resource
+func (r Resource) hasRoles(roles []string) bool {
+	if r.Match == matchAny {
+		return hasAnyRole(r.Roles, roles)
+	}
+
+	return hasRoles(r.Roles, roles)
+}
+
+// hasMethodRoles checks the user has the roles required by the resource for the method
+func (r Resource) hasMethodRoles(method string, roles []string) bool {
+	required, found := r.MethodRoles[method]
+	if !found {
+		return true
+	}
+	if r.Match == matchAny {
+		return hasAnyRole(required, roles)
+	}
+
+	return hasRoles(required, roles)
+}
+
+// getMethodRoles returns a list of roles required by the resource for the method
+func (r Resource) getMethodRoles(method string) string {
+	return strings.Join(r.MethodRoles[method], ",")
+}
+
+// hasGroups checks the user is a member of the groups required by the resource
+func (r Resource) hasGroups(groups []string) bool {
+	if r.Match == matchAny {
+		return hasAnyGroup(r.Groups, groups)
+	}
+
+	return hasGroups(r.Groups, groups)
+}
+
+// hasMethod checks the resource applies to the method
+func (r Resource) hasMethod(method string) bool {
+	if len(r.Methods) <= 0 {
+		return true
+	}
+
+	return containedIn("ANY", r.Methods) || containedIn(method, r.Methods)
+}
+
+// getGroups returns a list of groups for this resource
+func (r Resource) getGroups() string {
+	return strings.Join(r.Groups, ",")
+}
+
 // String returns a string representation of the resource
 func (r Resource) String() string {
 	if r.WhiteListed {
 		return fmt.Sprintf("uri: %s, white-listed", r.URL)
 	}
+	if r.Deny {
+		methods := "ANY"
+		if len(r.Methods) > 0 {
+			methods = strings.Join(r.Methods, ",")
+		}
+		if r.ReportOnly {
+			return fmt.Sprintf("uri: %s, methods: %s, denied, report-only", r.URL, methods)
+		}
+		return fmt.Sprintf("uri: %s, methods: %s, denied", r.URL, methods)
+	}
 
 	roles := "authentication only"
 	methods := "ANY"
@@ -113,5 +423,63 @@ func (r Resource) String() string {
 		methods = strings.Join(r.Methods, ",")
 	}
 
+	if len(r.Groups) > 0 {
+		roles = fmt.Sprintf("%s, groups: %s", roles, strings.Join(r.Groups, ","))
+	}
+	if len(r.MethodRoles) > 0 {
+		var methodRoles []string
+		for method, x := range r.MethodRoles {
+			methodRoles = append(methodRoles, fmt.Sprintf("%s=%s", method, strings.Join(x, ",")))
+		}
+		sort.Strings(methodRoles)
+		roles = fmt.Sprintf("%s, method-roles: %s", roles, strings.Join(methodRoles, ";"))
+	}
+	if r.Match == matchAny {
+		roles = fmt.Sprintf("%s, match: any", roles)
+	}
+	if r.Expression != "" {
+		roles = fmt.Sprintf("%s, expression: %s", roles, r.Expression)
+	}
+	if r.When != "" {
+		roles = fmt.Sprintf("%s, when: %s", roles, r.When)
+	}
+	if len(r.Bindings) > 0 {
+		var bindings []string
+		for name, claim := range r.Bindings {
+			bindings = append(bindings, fmt.Sprintf("%s=%s", name, claim))
+		}
+		sort.Strings(bindings)
+		roles = fmt.Sprintf("%s, bindings: %s", roles, strings.Join(bindings, ","))
+	}
+	if len(r.Claims) > 0 {
+		var claims []string
+		for name, value := range r.Claims {
+			claims = append(claims, fmt.Sprintf("%s=%s", name, value))
+		}
+		sort.Strings(claims)
+		roles = fmt.Sprintf("%s, claims: %s", roles, strings.Join(claims, ","))
+	}
+	if r.ACR != "" {
+		roles = fmt.Sprintf("%s, acr: %s", roles, r.ACR)
+	}
+	if r.MaxAge > 0 {
+		roles = fmt.Sprintf("%s, max-age: %s", roles, r.MaxAge)
+	}
+	if len(r.AllowedCIDRs) > 0 {
+		roles = fmt.Sprintf("%s, allowed-cidrs: %s", roles, strings.Join(r.AllowedCIDRs, ","))
+	}
+	if len(r.DeniedCIDRs) > 0 {
+		roles = fmt.Sprintf("%s, denied-cidrs: %s", roles, strings.Join(r.DeniedCIDRs, ","))
+	}
+	if r.Cors != nil {
+		roles = fmt.Sprintf("%s, cors-origins: %s", roles, strings.Join(r.Cors.Origins, ","))
+	}
+	if r.CSRFExempt {
+		roles = fmt.Sprintf("%s, csrf-exempt", roles)
+	}
+	if r.ReportOnly {
+		roles = fmt.Sprintf("%s, report-only", roles)
+	}
+
 	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
 }
@@ -17,6 +17,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -58,6 +59,123 @@ func TestDecodeResource(t *testing.T) {
 				Methods: []string{"GET", "POST"},
 			},
 		},
+		{
+			Option: "uri=/admin|groups=/org/dev,ops",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/admin",
+				Groups: []string{"/org/dev", "ops"},
+			},
+		},
+		{
+			Option: "uri=/admin|roles=admin,auditor|match=any|expression=claim:tenant=acme and not role:guest",
+			Ok:     true,
+			Resource: &Resource{
+				URL:        "/admin",
+				Roles:      []string{"admin", "auditor"},
+				Match:      "any",
+				Expression: "claim:tenant=acme and not role:guest",
+			},
+		},
+		{
+			Option: "uri=/finance|claim=tenant=^finance$|claim=level=>=3",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/finance",
+				Claims: map[string]string{"tenant": "^finance$", "level": ">=3"},
+			},
+		},
+		{
+			Option: "uri=/finance|claim=tenant",
+		},
+		{
+			Option: "uri=/users/{id}|bind=id=sub",
+			Ok:     true,
+			Resource: &Resource{
+				URL:      "/users/{id}",
+				Bindings: map[string]string{"id": "sub"},
+			},
+		},
+		{
+			Option: "uri=/users/{id}|bind=id",
+		},
+		{
+			Option: "uri=/api|roles=user|method-roles=GET=reader|method-roles=POST=writer,admin",
+			Ok:     true,
+			Resource: &Resource{
+				URL:         "/api",
+				Roles:       []string{"user"},
+				MethodRoles: map[string][]string{"GET": {"reader"}, "POST": {"writer", "admin"}},
+			},
+		},
+		{
+			Option: "uri=/api|method-roles=GET",
+		},
+		{
+			Option: "uri=/api/**|methods=DELETE|deny=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:     "/api/**",
+				Methods: []string{"DELETE"},
+				Deny:    true,
+			},
+		},
+		{
+			Option: "uri=/api|deny=bad",
+		},
+		{
+			Option: "uri=/admin|expression=role:admin || role:auditor|methods=GET",
+			Ok:     true,
+			Resource: &Resource{
+				URL:        "/admin",
+				Expression: "role:admin || role:auditor",
+				Methods:    []string{"GET"},
+			},
+		},
+		{
+			Option: "uri=/finance|when=request.method == 'GET' || 'admin' in roles||has(claims.tenant)|roles=user",
+			Ok:     true,
+			Resource: &Resource{
+				URL:   "/finance",
+				When:  "request.method == 'GET' || 'admin' in roles||has(claims.tenant)",
+				Roles: []string{"user"},
+			},
+		},
+		{
+			Option: "uri=~^/(reports|exports)/[0-9]+$|claim=tenant=^(acme|globex)$",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "~^/(reports|exports)/[0-9]+$",
+				Claims: map[string]string{"tenant": "^(acme|globex)$"},
+			},
+		},
+		{
+			Option: "uri=/admin|roles=admin|rols=admin",
+		},
+		{
+			Option: "uri=/partners|cors-origins=https://partner.com,https://*.partner.com|cors-methods=GET|cors-credentials=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/partners",
+				Cors: &Cors{
+					Origins:     []string{"https://partner.com", "https://*.partner.com"},
+					Methods:     []string{"GET"},
+					Credentials: true,
+				},
+			},
+		},
+		{
+			Option: "uri=/partners|cors-credentials=bad",
+		},
+		{
+			Option: "uri=/admin|allowed-cidrs=10.8.0.0/16,10.9.0.0/16|denied-cidrs=10.8.1.1",
+			Ok:     true,
+			Resource: &Resource{
+				URL:          "/admin",
+				AllowedCIDRs: []string{"10.8.0.0/16", "10.9.0.0/16"},
+				DeniedCIDRs:  []string{"10.8.1.1"},
+			},
+		},
 		{
 			Option: "uri=/allow_me|white-listed=true",
 			Ok:     true,
@@ -66,6 +184,18 @@ func TestDecodeResource(t *testing.T) {
 				WhiteListed: true,
 			},
 		},
+		{
+			Option: "uri=/admin|acr=2|max-age=10m",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/admin",
+				ACR:    "2",
+				MaxAge: time.Duration(10) * time.Minute,
+			},
+		},
+		{
+			Option: "uri=/admin|max-age=bad",
+		},
 		{
 			Option: "",
 		},
@@ -116,6 +246,72 @@ func TestIsValid(t *testing.T) {
 	}
 }
 
+func TestIsValidMatch(t *testing.T) {
+	cs := []struct {
+		Resource *Resource
+		Ok       bool
+	}{
+		{Resource: &Resource{URL: "/test", Roles: []string{"a"}}, Ok: true},
+		{Resource: &Resource{URL: "/test", Roles: []string{"a"}, Match: "any"}, Ok: true},
+		{Resource: &Resource{URL: "/test", Roles: []string{"a"}, Match: "some"}},
+		{Resource: &Resource{URL: "/test", Expression: "role:a or group:/b"}, Ok: true},
+		{Resource: &Resource{URL: "/test", Expression: "role:a or"}},
+		{Resource: &Resource{URL: "/test", When: "'a' in roles && request.method != 'DELETE'"}, Ok: true},
+		{Resource: &Resource{URL: "/test", When: "'a' in"}},
+		{Resource: &Resource{URL: "/test", Claims: map[string]string{"level": ">=3"}}, Ok: true},
+		{Resource: &Resource{URL: "/test", Claims: map[string]string{"level": ">=high"}}},
+		{Resource: &Resource{URL: "/users/:id", Bindings: map[string]string{"id": "sub"}}, Ok: true},
+		{Resource: &Resource{URL: "~^/users/(?P<id>[^/]+)$", Bindings: map[string]string{"id": "sub"}}, Ok: true},
+		{Resource: &Resource{URL: "/users/:id", Bindings: map[string]string{"user": "sub"}}},
+		{Resource: &Resource{URL: "/users", Bindings: map[string]string{"id": "sub"}}},
+		{Resource: &Resource{URL: "/api", MethodRoles: map[string][]string{"get": {"reader"}}}, Ok: true},
+		{Resource: &Resource{URL: "/api", MethodRoles: map[string][]string{"FETCH": {"reader"}}}},
+		{Resource: &Resource{URL: "/api", MethodRoles: map[string][]string{"ANY": {"reader"}}}},
+		{Resource: &Resource{URL: "/api", MethodRoles: map[string][]string{"GET": {}}}},
+		{Resource: &Resource{URL: "/api", Methods: []string{"DELETE"}, Deny: true}, Ok: true},
+		{Resource: &Resource{URL: "/api", Deny: true, WhiteListed: true}},
+		{Resource: &Resource{URL: "/api", AllowedCIDRs: []string{"10.0.0.0/8"}, DeniedCIDRs: []string{"10.1.1.1"}}, Ok: true},
+		{Resource: &Resource{URL: "/api", AllowedCIDRs: []string{"10.0.0.0/40"}}},
+		{Resource: &Resource{URL: "/api", Deny: true, Roles: []string{"admin"}}},
+	}
+	for i, c := range cs {
+		err := c.Resource.valid()
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.NotEmpty(t, c.Resource.Match, "case %d should have a match", i)
+			assert.Equal(t, c.Resource.Expression != "", c.Resource.expression != nil, "case %d", i)
+		}
+	}
+}
+
+func TestHasMethodRoles(t *testing.T) {
+	resource := &Resource{
+		URL:         "/api",
+		MethodRoles: map[string][]string{"get": {"reader"}, "POST": {"writer", "admin"}},
+	}
+	assert.NoError(t, resource.valid())
+	cs := []struct {
+		Method   string
+		Match    string
+		Roles    []string
+		Expected bool
+	}{
+		{Method: "GET", Roles: []string{"reader"}, Expected: true},
+		{Method: "GET", Roles: []string{"writer"}},
+		{Method: "POST", Roles: []string{"writer"}},
+		{Method: "POST", Roles: []string{"writer", "admin"}, Expected: true},
+		{Method: "POST", Match: matchAny, Roles: []string{"writer"}, Expected: true},
+		{Method: "DELETE", Expected: true},
+	}
+	for i, c := range cs {
+		resource.Match = c.Match
+		assert.Equal(t, c.Expected, resource.hasMethodRoles(c.Method, c.Roles), "case %d", i)
+	}
+}
+
 func TestResourceString(t *testing.T) {
 	resource := &Resource{
 		Roles: []string{"1", "2", "3"},
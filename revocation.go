@@ -0,0 +1,110 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+const (
+	// actionPushNotBefore is the keycloak admin action for pushing a not-before policy
+	actionPushNotBefore = "PUSH_NOT_BEFORE"
+)
+
+// notBeforePolicy holds the not-before times pushed by the keycloak admin, keyed by realm and client
+type notBeforePolicy struct {
+	sync.RWMutex
+	// policies is a map of realm/client to not-before time
+	policies map[string]time.Time
+}
+
+// newNotBeforePolicy creates a empty not-before policy
+func newNotBeforePolicy() *notBeforePolicy {
+	return &notBeforePolicy{
+		policies: make(map[string]time.Time, 0),
+	}
+}
+
+// set records the not-before time for the realm and client
+func (n *notBeforePolicy) set(realm, client string, notBefore time.Time) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.policies[realm+"/"+client] = notBefore
+}
+
+// get retrieves the not-before time for the realm and client, if any
+func (n *notBeforePolicy) get(realm, client string) (time.Time, bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	notBefore, found := n.policies[realm+"/"+client]
+
+	return notBefore, found
+}
+
+// isRevoked checks if the token was issued before a not-before policy for the realm and client
+func (n *notBeforePolicy) isRevoked(user *userContext) bool {
+	// step: the client can be either the authorized party or the audience of the token
+	authorized, _, _ := user.claims.StringClaim(claimAuthorizedBy)
+	for _, client := range []string{user.audience, authorized} {
+		if client == "" {
+			continue
+		}
+		if notBefore, found := n.get(user.issuer, client); found && user.issuedAt.Before(notBefore) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeNotBeforeAction verifies the signature of the admin action and decodes the content
+func decodeNotBeforeAction(content string, keys []key.PublicKey) (*notBeforeAction, error) {
+	token, err := jose.ParseJWT(content)
+	if err != nil {
+		return nil, err
+	}
+	// step: ensure the action has been signed by the realm
+	verified, err := oidc.VerifySignature(token, keys)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, errors.New("unable to verify the signature of the admin action")
+	}
+	// step: decode the action
+	action := &notBeforeAction{}
+	if err := json.Unmarshal(token.Payload, action); err != nil {
+		return nil, err
+	}
+	if action.Action != actionPushNotBefore {
+		return nil, fmt.Errorf("invalid admin action: %s", action.Action)
+	}
+	if action.Expiration > 0 && time.Unix(action.Expiration, 0).Before(time.Now()) {
+		return nil, errors.New("the admin action has expired")
+	}
+
+	return action, nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeNotBeforeAction(idp *fakeOAuthServer, action string, expiration time.Time) string {
+	token, err := idp.signToken(jose.Claims{
+		"id":         "6f1e2bd0-5b1f-4b2b-a2b4-8d8b6e35ca1b",
+		"action":     action,
+		"resource":   "test",
+		"expiration": expiration.Unix(),
+		"notBefore":  time.Now().Unix(),
+	})
+	if err != nil {
+		panic("unable to sign the admin action, error: " + err.Error())
+	}
+
+	return token.Encode()
+}
+
+func TestNotBeforePolicy(t *testing.T) {
+	policy := newNotBeforePolicy()
+	_, found := policy.get("realm", "test")
+	assert.False(t, found)
+
+	now := time.Now()
+	policy.set("realm", "test", now)
+	notBefore, found := policy.get("realm", "test")
+	assert.True(t, found)
+	assert.Equal(t, now, notBefore)
+	_, found = policy.get("other", "test")
+	assert.False(t, found)
+}
+
+func TestNotBeforePolicyIsRevoked(t *testing.T) {
+	policy := newNotBeforePolicy()
+	policy.set("realm", "test", time.Now())
+	cs := []struct {
+		User    *userContext
+		Revoked bool
+	}{
+		{
+			User: &userContext{
+				audience: "test",
+				issuer:   "realm",
+				issuedAt: time.Now().Add(-1 * time.Hour),
+				claims:   jose.Claims{},
+			},
+			Revoked: true,
+		},
+		{
+			User: &userContext{
+				audience: "test",
+				issuer:   "realm",
+				issuedAt: time.Now().Add(1 * time.Hour),
+				claims:   jose.Claims{},
+			},
+		},
+		{
+			User: &userContext{
+				audience: "other",
+				issuer:   "realm",
+				issuedAt: time.Now().Add(-1 * time.Hour),
+				claims:   jose.Claims{"azp": "test"},
+			},
+			Revoked: true,
+		},
+		{
+			User: &userContext{
+				audience: "test",
+				issuer:   "other",
+				issuedAt: time.Now().Add(-1 * time.Hour),
+				claims:   jose.Claims{},
+			},
+		},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Revoked, policy.isRevoked(c.User), "case %d, expected: %t", i, c.Revoked)
+	}
+}
+
+func TestDecodeNotBeforeAction(t *testing.T) {
+	idp := newFakeOAuthServer()
+	unsigned := newFakeAccessToken(nil, 0)
+	keys := []key.PublicKey{*key.NewPublicKey(idp.key)}
+	cs := []struct {
+		Content string
+		Ok      bool
+	}{
+		{
+			Content: newFakeNotBeforeAction(idp, actionPushNotBefore, time.Now().Add(time.Minute)),
+			Ok:      true,
+		},
+		{
+			Content: newFakeNotBeforeAction(idp, actionPushNotBefore, time.Now().Add(-1*time.Minute)),
+		},
+		{
+			Content: newFakeNotBeforeAction(idp, "LOGOUT", time.Now().Add(time.Minute)),
+		},
+		{
+			Content: "not.a.token",
+		},
+		{
+			Content: unsigned.Encode(),
+		},
+	}
+	for i, c := range cs {
+		action, err := decodeNotBeforeAction(c.Content, keys)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, "test", action.Resource)
+		}
+	}
+}
@@ -32,7 +32,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armon/go-proxyproto"
-	"github.com/coreos/go-oidc/oidc"
 	"github.com/gambol99/goproxy"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -43,18 +42,36 @@ type oauthProxy struct {
 	config *Config
 	// the gin service
 	router http.Handler
-	// the opened client
-	client *oidc.Client
-	// the openid provider configuration
-	idp oidc.ProviderConfig
-	// the provider http client
-	idpClient *http.Client
+	// the openid provider
+	provider providerState
+	// the public keys used to verify tokens offline
+	keys *keySetVerifier
+	// the keys retrieved from the provider
+	jwks *remoteKeySet
 	// the proxy client
 	upstream reverseProxy
 	// the upstream endpoint url
 	endpoint *url.URL
 	// the store interface
 	store storage
+	// the not-before policies pushed from the admin console
+	notBefore *notBeforePolicy
+	// the matcher for the protected resources
+	resources *resourceMatcher
+	// the external authorizer for the protected resources
+	authorizer *externalAuthorizer
+	// the mapping of the claims to the user identity
+	claims *claimMapping
+	// the in-flight refreshes of access tokens
+	refreshes *refreshGroup
+	// the networks permitted to access the proxy
+	networks *networkPolicy
+	// the proxies trusted to forward the client address
+	trustedProxies []*net.IPNet
+	// the external hosts the redirection url may be derived from
+	redirectionHosts []*redirectionHost
+	// the would-be denials of the resources in report-only mode
+	reportDenials *prometheus.CounterVec
 	// the prometheus handler
 	prometheusHandler http.Handler
 }
@@ -88,9 +105,48 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	svc := &oauthProxy{
 		config:            config,
+		notBefore:         newNotBeforePolicy(),
+		refreshes:         newRefreshGroup(),
 		prometheusHandler: prometheus.Handler(),
 	}
 
+	// step: create the counter for the would-be denials in report-only mode
+	svc.reportDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_report_only_denials_total",
+			Help: "The requests which would have been denied by the resources in report-only mode",
+		},
+		[]string{"resource"},
+	)
+	if collector, err := prometheus.RegisterOrGet(svc.reportDenials); err == nil {
+		svc.reportDenials = collector.(*prometheus.CounterVec)
+	}
+
+	// step: parse the networks permitted to access the proxy
+	if svc.networks, err = newNetworkPolicy(config.AllowedCIDRs, config.DeniedCIDRs); err != nil {
+		return nil, err
+	}
+	if svc.trustedProxies, err = parseCIDRs(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for _, x := range config.RedirectionHosts {
+		host, err := parseRedirectionHost(x)
+		if err != nil {
+			return nil, err
+		}
+		svc.redirectionHosts = append(svc.redirectionHosts, host)
+	}
+
+	// step: create the mapping of the claims to the identity
+	if svc.claims, err = newClaimMapping(config); err != nil {
+		return nil, err
+	}
+
+	// step: are we using an external authorizer?
+	if config.AuthorizerURL != "" {
+		svc.authorizer = newExternalAuthorizer(config)
+	}
+
 	// step: parse the upstream endpoint
 	if svc.endpoint, err = url.Parse(config.Upstream); err != nil {
 		return nil, err
@@ -105,8 +161,28 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	// step: initialize the openid client
 	if !config.SkipTokenVerification {
-		if svc.client, svc.idp, svc.idpClient, err = newOpenIDClient(config); err != nil {
-			return nil, err
+		// step: attempt to discover the provider, if unavailable we continue and retry in the background
+		if config.DiscoveryURL != "" {
+			svc.jwks = newRemoteKeySet(config.ClientID, config.getIssuer(), config.JWKSCacheFile, config.ClockSkew)
+			if err := svc.discoverProvider(); err != nil {
+				log.WithFields(log.Fields{
+					"discovery_url": config.DiscoveryURL,
+					"error":         err.Error(),
+				}).Warnf("unable to retrieve the provider configuration, retrying in the background")
+
+				go svc.retryProviderDiscovery()
+			} else {
+				log.Infof("successfully retrieved the openid configuration from the discovery url: %s", config.DiscoveryURL)
+			}
+		}
+		// step: are we verifying the tokens with local public keys?
+		if len(config.PublicKeyFiles) > 0 {
+			if svc.keys, err = newKeySetVerifier(config.PublicKeyFiles, config.TokenIssuer, config.ClientID, config.ClockSkew); err != nil {
+				return nil, err
+			}
+			if err := svc.keys.watch(); err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		log.Warnf("TESTING ONLY CONFIG - the verification of the token have been disabled")
@@ -137,13 +213,23 @@ func (r *oauthProxy) createReverseProxy() error {
 
 	// step: display the protected resources
 	for _, resource := range r.config.Resources {
+		// step: ensure the resource has been compiled, the resource may not have been validated
+		if !resource.isCompiled() {
+			if err := resource.compile(); err != nil {
+				return err
+			}
+		}
 		log.Infof("protecting resources under uri: %s", resource)
 	}
+	var err error
+	if r.resources, err = newResourceMatcher(r.config.Resources); err != nil {
+		return err
+	}
 	for name, value := range r.config.MatchClaims {
 		log.Infof("the token must container the claim: %s, required: %s", name, value)
 	}
-	if r.config.RedirectionURL == "" {
-		log.Warnf("no redirection url has been set, will use host headers")
+	if r.config.RedirectionURL == "" && len(r.redirectionHosts) <= 0 {
+		log.Warnf("no redirection url or hosts have been set, will use host headers")
 	}
 
 	// step: initialize the reverse http proxy
@@ -156,6 +242,8 @@ func (r *oauthProxy) createReverseProxy() error {
 	engine.Use(gin.Recovery())
 	// step: custom filtering
 	engine.Use(r.filterMiddleware())
+	// step: remove the identity headers supplied by the client
+	engine.Use(r.scrubHeadersMiddleware())
 
 	// step: is profiling enabled?
 	if r.config.EnableProfiling {
@@ -174,13 +262,16 @@ func (r *oauthProxy) createReverseProxy() error {
 	if r.config.EnableSecurityFilter {
 		engine.Use(r.securityMiddleware())
 	}
-	cors := Cors{
+	cors, err := newCorsPolicy(Cors{
 		Origins:        r.config.CorsOrigins,
 		Methods:        r.config.CorsMethods,
 		Headers:        r.config.CorsHeaders,
 		ExposedHeaders: r.config.CorsExposedHeaders,
 		Credentials:    r.config.CorsCredentials,
 		MaxAge:         r.config.CorsMaxAge,
+	})
+	if err != nil {
+		return err
 	}
 	// step: enabling globaling?
 	if r.config.EnableCorsGlobal {
@@ -192,21 +283,39 @@ func (r *oauthProxy) createReverseProxy() error {
 	if !r.config.EnableCorsGlobal {
 		oauth.Use(r.corsMiddleware(cors))
 	}
-	oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
-	oauth.GET(callbackURL, r.oauthCallbackHandler)
+	oauth.GET(authorizationURL, r.providerMiddleware(), r.oauthAuthorizationHandler)
+	oauth.GET(callbackURL, r.providerMiddleware(), r.oauthCallbackHandler)
 	oauth.GET(healthURL, r.healthHandler)
+	oauth.GET(readyURL, r.readyHandler)
 	oauth.GET(tokenURL, r.tokenHandler)
 	oauth.GET(expiredURL, r.expirationHandler)
-	oauth.GET(logoutURL, r.logoutHandler)
-	oauth.POST(loginURL, r.loginHandler)
+	oauth.GET(logoutURL, r.providerMiddleware(), r.logoutHandler)
+	oauth.POST(loginURL, r.providerMiddleware(), r.loginHandler)
 	// step: enable the metric page?
 	if r.config.EnableMetrics {
 		oauth.GET(metricsURL, r.metricsHandler)
 	}
+	// step: enable the keycloak admin not-before push?
+	if r.config.EnableNotBeforePush {
+		oauth.POST(notBeforeURL, r.providerMiddleware(), r.notBeforeHandler)
+	}
+
+	// step: the cors options of the resources apply regardless of the global cors
+	if !r.config.EnableCorsGlobal {
+		for _, resource := range r.config.Resources {
+			if resource.cors != nil {
+				engine.Use(r.corsMiddleware(nil))
+				break
+			}
+		}
+	}
 
 	// step: add the middleware
-	engine.Use(r.entrypointMiddleware(), r.authenticationMiddleware(), r.admissionMiddleware(),
-		r.headersMiddleware(r.config.AddClaims), r.reverseProxyMiddleware())
+	engine.Use(r.entrypointMiddleware(), r.authenticationMiddleware())
+	if r.config.EnableCSRF {
+		engine.Use(r.csrfMiddleware())
+	}
+	engine.Use(r.admissionMiddleware(), r.headersMiddleware(r.config.AddClaims), r.reverseProxyMiddleware())
 
 	// step: set the handler
 	r.router = engine
@@ -280,7 +389,9 @@ func (r *oauthProxy) createForwardingProxy() error {
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		ctx.UserData = time.Now()
 		// step: forward into the handler
-		forwardingHandler(req, ctx.Resp)
+		if resp := forwardingHandler(req); resp != nil {
+			return req, resp
+		}
 
 		return req, ctx.Resp
 	})
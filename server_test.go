@@ -133,7 +133,10 @@ type testJWTToken struct {
 }
 
 func newTestToken(issuer string) *testJWTToken {
-	claims := defaultTestTokenClaims
+	claims := make(jose.Claims, 0)
+	for k, v := range defaultTestTokenClaims {
+		claims[k] = v
+	}
 	claims.Add("exp", float64(time.Now().Add(1*time.Hour).Unix()))
 	claims.Add("iat", float64(time.Now().Unix()))
 	claims.Add("iss", issuer)
@@ -283,10 +286,11 @@ func newTestProxyService(config *Config) (*oauthProxy, *fakeOAuthServer, string)
 	config.RedirectionURL = service.URL
 
 	// step: we need to update the client config
-	proxy.client, proxy.idp, proxy.idpClient, err = newOpenIDClient(config)
+	client, idp, hc, err := newOpenIDClient(config)
 	if err != nil {
 		panic("failed to recreate the openid client, error: " + err.Error())
 	}
+	proxy.setProvider(client, idp, hc)
 
 	return proxy, auth, service.URL
 }
@@ -39,7 +39,7 @@ func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	}
 
 	// step: parse the access token and extract the user identity
-	user, err := extractIdentity(token)
+	user, err := extractIdentity(token, r.claims)
 	if err != nil {
 		return nil, err
 	}
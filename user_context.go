@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,7 +26,10 @@ import (
 )
 
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
-func extractIdentity(token jose.JWT) (*userContext, error) {
+func extractIdentity(token jose.JWT, mapping *claimMapping) (*userContext, error) {
+	if mapping == nil {
+		mapping = defaultClaimMapping
+	}
 	// step: decode the claims from the tokens
 	claims, err := token.Claims()
 	if err != nil {
@@ -36,47 +40,42 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	// step: extract the email of the user, falling back to the standard claim
+	email := mapping.getEmail(claims)
+	if email == "" {
+		email = identity.Email
+	}
 	// step: ensure we have and can extract the preferred name of the user, if not, we set to the ID
-	preferredName, found, err := claims.StringClaim(claimPreferredName)
-	if err != nil || !found {
+	preferredName := mapping.getUsername(claims)
+	if preferredName == "" {
 		// choice: set the preferredName to the Email if claim not found
-		preferredName = identity.Email
+		preferredName = email
 	}
 	// step: retrieve the audience from access token
 	audience, found, err := claims.StringClaim(claimAudience)
 	if err != nil || !found {
 		return nil, ErrNoTokenAudience
 	}
-	// step: extract the realm roles
-	var list []string
-	if realmRoles, found := claims[claimRealmAccess].(map[string]interface{}); found {
-		if roles, found := realmRoles[claimResourceRoles]; found {
-			for _, r := range roles.([]interface{}) {
-				list = append(list, fmt.Sprintf("%s", r))
-			}
-		}
-	}
-
-	// step: extract the roles from the access token
-	if accesses, found := claims[claimResourceAccess].(map[string]interface{}); found {
-		for roleName, roleList := range accesses {
-			scopes := roleList.(map[string]interface{})
-			if roles, found := scopes[claimResourceRoles]; found {
-				for _, r := range roles.([]interface{}) {
-					list = append(list, fmt.Sprintf("%s:%s", roleName, r))
-				}
-			}
-		}
-	}
+	// step: extract the issuer and time the token was issued, neither is mandatory
+	issuer, _, _ := claims.StringClaim(claimIssuer)
+	issuedAt, _, _ := claims.TimeClaim(claimIssuedAt)
+	// step: extract the authentication context and time, used for step-up authentication
+	acr, _, _ := claims.StringClaim(claimACR)
+	authTime, _, _ := claims.TimeClaim(claimAuthTime)
 
 	return &userContext{
 		id:            identity.ID,
 		name:          preferredName,
 		audience:      audience,
 		preferredName: preferredName,
-		email:         identity.Email,
+		email:         email,
 		expiresAt:     identity.ExpiresAt,
-		roles:         list,
+		issuedAt:      issuedAt,
+		issuer:        issuer,
+		acr:           acr,
+		authTime:      authTime,
+		roles:         mapping.getRoles(claims),
+		groups:        mapping.getGroups(claims),
 		token:         token,
 		claims:        claims,
 	}, nil
@@ -96,9 +95,34 @@ func (r userContext) getRoles() string {
 	return strings.Join(r.roles, ",")
 }
 
-// isExpired checks if the token has expired
-func (r userContext) isExpired() bool {
-	return r.expiresAt.Before(time.Now())
+// getGroups returns a list of groups
+func (r userContext) getGroups() string {
+	return strings.Join(r.groups, ",")
+}
+
+// isExpired checks if the token has expired, allowing for the clock skew
+func (r userContext) isExpired(leeway time.Duration) bool {
+	return r.expiresAt.Add(leeway).Before(time.Now())
+}
+
+// hasAuthentication checks the session satisfies the authentication context class and was
+// authenticated within the max age; numeric classes are treated as levels of assurance
+func (r userContext) hasAuthentication(acr string, maxAge time.Duration) bool {
+	if acr != "" && r.acr != acr {
+		required, err := strconv.Atoi(acr)
+		if err != nil {
+			return false
+		}
+		level, err := strconv.Atoi(r.acr)
+		if err != nil || level < required {
+			return false
+		}
+	}
+	if maxAge > 0 && (r.authTime.IsZero() || time.Now().Sub(r.authTime) > maxAge) {
+		return false
+	}
+
+	return true
 }
 
 // isBearerToken checks if the token
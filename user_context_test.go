@@ -50,11 +50,68 @@ func TestIsExpired(t *testing.T) {
 	user := &userContext{
 		expiresAt: time.Now(),
 	}
-	if !user.isExpired() {
+	if !user.isExpired(0) {
 		t.Error("we should have been false")
 	}
 }
 
+func TestHasAuthentication(t *testing.T) {
+	cs := []struct {
+		User     *userContext
+		ACR      string
+		MaxAge   time.Duration
+		Expected bool
+	}{
+		{
+			User:     &userContext{},
+			Expected: true,
+		},
+		{
+			User:     &userContext{acr: "1"},
+			ACR:      "1",
+			Expected: true,
+		},
+		{
+			User:     &userContext{acr: "2"},
+			ACR:      "1",
+			Expected: true,
+		},
+		{
+			User: &userContext{acr: "1"},
+			ACR:  "2",
+		},
+		{
+			User:     &userContext{acr: "urn:mfa"},
+			ACR:      "urn:mfa",
+			Expected: true,
+		},
+		{
+			User: &userContext{acr: "urn:pwd"},
+			ACR:  "urn:mfa",
+		},
+		{
+			User: &userContext{},
+			ACR:  "1",
+		},
+		{
+			User:     &userContext{authTime: time.Now().Add(-1 * time.Minute)},
+			MaxAge:   time.Duration(5) * time.Minute,
+			Expected: true,
+		},
+		{
+			User:   &userContext{authTime: time.Now().Add(-10 * time.Minute)},
+			MaxAge: time.Duration(5) * time.Minute,
+		},
+		{
+			User:   &userContext{},
+			MaxAge: time.Duration(5) * time.Minute,
+		},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, c.User.hasAuthentication(c.ACR, c.MaxAge), "case %d, expected: %t", i, c.Expected)
+	}
+}
+
 func TestIsBearerToken(t *testing.T) {
 	user := &userContext{
 		bearerToken: true,
@@ -74,7 +131,7 @@ func TestIsCookie(t *testing.T) {
 func TestGetUserContext(t *testing.T) {
 	roles := []string{"openvpn:dev-vpn"}
 
-	context, err := extractIdentity(newFakeAccessToken(nil, 0))
+	context, err := extractIdentity(newFakeAccessToken(nil, 0), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -86,7 +143,7 @@ func TestGetUserContext(t *testing.T) {
 func TestGetUserRealmRoleContext(t *testing.T) {
 	roles := []string{"dsp-dev-vpn", "vpn-user", "dsp-prod-vpn", "openvpn:dev-vpn"}
 
-	context, err := extractIdentity(getFakeRealmAccessToken(t))
+	context, err := extractIdentity(getFakeRealmAccessToken(t), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -96,7 +153,7 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 }
 
 func TestUserContextString(t *testing.T) {
-	context, err := extractIdentity(newFakeAccessToken(nil, 0))
+	context, err := extractIdentity(newFakeAccessToken(nil, 0), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.NotEmpty(t, context.String())
@@ -35,6 +35,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -163,24 +164,9 @@ func newOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, *http.Clie
 	}
 
 	// step: attempt to retrieve the provider configuration
-	completeCh := make(chan bool)
-	go func() {
-		for {
-			log.Infof("attempting to retrieve openid configuration from discovery url: %s", cfg.DiscoveryURL)
-			if config, err = oidc.FetchProviderConfig(hc, cfg.DiscoveryURL); err == nil {
-				break // break and complete
-			}
-			log.Warnf("failed to get provider configuration from discovery url: %s, %s", cfg.DiscoveryURL, err)
-			time.Sleep(time.Second * 3)
-		}
-		completeCh <- true
-	}()
-	// step: wait for timeout or successful retrieval
-	select {
-	case <-time.After(30 * time.Second):
-		return nil, config, nil, errors.New("failed to retrieve the provider configuration from discovery url")
-	case <-completeCh:
-		log.Infof("successfully retrieved the openid configuration from the discovery url: %s", cfg.DiscoveryURL)
+	log.Infof("attempting to retrieve openid configuration from discovery url: %s", cfg.DiscoveryURL)
+	if config, err = oidc.FetchProviderConfig(hc, cfg.DiscoveryURL); err != nil {
+		return nil, config, nil, fmt.Errorf("failed to retrieve the provider configuration from discovery url: %s", err)
 	}
 
 	client, err := oidc.NewClient(oidc.ClientConfig{
@@ -197,9 +183,6 @@ func newOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, *http.Clie
 		return nil, config, hc, err
 	}
 
-	// step: start the provider sync for key rotation
-	client.SyncProviderConfig(cfg.DiscoveryURL)
-
 	return client, config, hc, nil
 }
 
@@ -223,6 +206,11 @@ func isValidHTTPMethod(method string) bool {
 	return httpMethodRegex.MatchString(method)
 }
 
+// normalizeHeaderName returns the canonical form of the header name, treating any _ as a -
+func normalizeHeaderName(name string) string {
+	return http.CanonicalHeaderKey(strings.Replace(name, "_", "-", -1))
+}
+
 // defaultTo returns the value of the default
 func defaultTo(v, d string) string {
 	if v != "" {
@@ -282,6 +270,61 @@ func hasRoles(required, issued []string) bool {
 	return true
 }
 
+// hasAnyRole checks at least one of the required roles has been issued
+func hasAnyRole(required, issued []string) bool {
+	for _, role := range required {
+		if containedIn(role, issued) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAnyGroup checks the user is a member of at least one of the required groups
+func hasAnyGroup(required, issued []string) bool {
+	for _, group := range required {
+		if isGroupMember(group, issued) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasGroups checks the user is a member of all the required groups; a group given as a full path
+// i.e. /org/dev is satisfied by membership of the group or any of its sub-groups, while a group
+// given by name is satisfied by any group of that name
+func hasGroups(required, issued []string) bool {
+	for _, group := range required {
+		if !isGroupMember(group, issued) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isGroupMember checks if the group is satisfied by any of the groups; a full path is satisfied by the
+// group or its sub-groups, while a bare name only matches a top-level group, i.e. admins is satisfied
+// by /admins but not /tenant-x/admins
+func isGroupMember(group string, groups []string) bool {
+	for _, x := range groups {
+		switch {
+		case x == group:
+			return true
+		case strings.HasPrefix(group, "/"):
+			if strings.HasPrefix(x, strings.TrimSuffix(group, "/")+"/") {
+				return true
+			}
+		case x == "/"+group:
+			return true
+		}
+	}
+
+	return false
+}
+
 // containedIn checks if a value in a list of a strings
 func containedIn(value string, list []string) bool {
 	for _, x := range list {
@@ -454,6 +497,35 @@ func getWithin(expires time.Time, in float64) time.Duration {
 	return time.Duration(seconds) * time.Second
 }
 
+// isInteractionRequired checks if the authorization error indicates the user must interact with the provider
+func isInteractionRequired(err string) bool {
+	switch err {
+	case "login_required", "interaction_required", "consent_required", "account_selection_required":
+		return true
+	}
+
+	return false
+}
+
+// parseRefreshWindow parses the refresh window, either a duration i.e. 30s or a percentage of the
+// token lifetime i.e. 20%
+func parseRefreshWindow(window string) (time.Duration, float64, error) {
+	if strings.HasSuffix(window, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(window, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return 0, 0, fmt.Errorf("the refresh window: %s must be a percentage between 0 and 100", window)
+		}
+
+		return 0, percent / 100, nil
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return 0, 0, fmt.Errorf("the refresh window: %s must be a positive duration or percentage", window)
+	}
+
+	return duration, 0, nil
+}
+
 // getHashKey returns a hash of the encodes jwt token
 func getHashKey(token *jose.JWT) string {
 	hash := md5.Sum([]byte(token.Encode()))
@@ -222,6 +222,45 @@ func TestHasRoles(t *testing.T) {
 	}
 }
 
+func TestHasAnyRole(t *testing.T) {
+	assert.True(t, hasAnyRole([]string{"admin", "auditor"}, []string{"auditor"}))
+	assert.True(t, hasAnyRole([]string{"admin"}, []string{"user", "admin"}))
+	assert.False(t, hasAnyRole([]string{"admin", "auditor"}, []string{"user"}))
+	assert.False(t, hasAnyRole([]string{"admin"}, []string{}))
+}
+
+func TestHasAnyGroup(t *testing.T) {
+	assert.True(t, hasAnyGroup([]string{"/org/dev", "/org/ops"}, []string{"/org/ops/oncall"}))
+	assert.True(t, hasAnyGroup([]string{"dev", "ops"}, []string{"/dev"}))
+	assert.False(t, hasAnyGroup([]string{"dev", "ops"}, []string{"/org/dev"}))
+	assert.False(t, hasAnyGroup([]string{"/org/dev", "/org/ops"}, []string{"/org/sales"}))
+}
+
+func TestHasGroups(t *testing.T) {
+	cs := []struct {
+		Groups   []string
+		Required []string
+		Ok       bool
+	}{
+		{Groups: []string{"/org/dev"}, Required: []string{"/org/dev"}, Ok: true},
+		{Groups: []string{"/org/dev/backend"}, Required: []string{"/org/dev"}, Ok: true},
+		{Groups: []string{"/org/dev/backend"}, Required: []string{"/org/dev/"}, Ok: true},
+		{Groups: []string{"/org/developers"}, Required: []string{"/org/dev"}},
+		{Groups: []string{"/org/dev"}, Required: []string{"/org/dev/backend"}},
+		{Groups: []string{"/dev"}, Required: []string{"dev"}, Ok: true},
+		{Groups: []string{"/org/dev"}, Required: []string{"dev"}},
+		{Groups: []string{"/tenant-x/admins"}, Required: []string{"admins"}},
+		{Groups: []string{"dev"}, Required: []string{"dev"}, Ok: true},
+		{Groups: []string{"/dev/backend"}, Required: []string{"dev"}},
+		{Groups: []string{"/org/dev", "/ops"}, Required: []string{"/org/dev", "ops"}, Ok: true},
+		{Groups: []string{"/org/dev"}, Required: []string{"/org/dev", "ops"}},
+		{Required: []string{"dev"}},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Ok, hasGroups(c.Required, c.Groups), "case %d, groups: %s, required: %s", i, c.Groups, c.Required)
+	}
+}
+
 func TestContainedIn(t *testing.T) {
 	assert.False(t, containedIn("1", []string{"2", "3", "4"}))
 	assert.True(t, containedIn("1", []string{"1", "2", "3", "4"}))
@@ -319,6 +358,33 @@ func TestGetWithin(t *testing.T) {
 	}
 }
 
+func TestParseRefreshWindow(t *testing.T) {
+	cs := []struct {
+		Window   string
+		Duration time.Duration
+		Percent  float64
+		Ok       bool
+	}{
+		{Window: "30s", Duration: 30 * time.Second, Ok: true},
+		{Window: "20%", Percent: 0.2, Ok: true},
+		{Window: "0%"},
+		{Window: "120%"},
+		{Window: "-10s"},
+		{Window: "bad"},
+		{Window: ""},
+	}
+	for i, c := range cs {
+		duration, percent, err := parseRefreshWindow(c.Window)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+		assert.Equal(t, c.Duration, duration, "case %d, expected: %s", i, c.Duration)
+		assert.Equal(t, c.Percent, percent, "case %d, expected: %f", i, c.Percent)
+	}
+}
+
 func TestToHeader(t *testing.T) {
 	cases := []struct {
 		Word     string
@@ -0,0 +1,259 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/fsnotify/fsnotify"
+)
+
+// tokenVerifier is the interface for verifying the signature and claims of a token
+type tokenVerifier interface {
+	// VerifyJWT verifies the token
+	VerifyJWT(jose.JWT) error
+}
+
+// keySetVerifier verifies tokens offline using public keys loaded from local JWKS or PEM files
+type keySetVerifier struct {
+	sync.RWMutex
+	// the public keys used to verify the tokens
+	keys []key.PublicKey
+	// the files holding the keys
+	files []string
+	// the expected issuer of the tokens
+	issuer string
+	// the client id expected in the audience
+	clientID string
+	// the leeway allowed on the time claims
+	leeway time.Duration
+}
+
+// newKeySetVerifier creates a verifier from the public key files
+func newKeySetVerifier(files []string, issuer, clientID string, leeway time.Duration) (*keySetVerifier, error) {
+	keys, err := loadPublicKeyFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keySetVerifier{
+		keys:     keys,
+		files:    files,
+		issuer:   issuer,
+		clientID: clientID,
+		leeway:   leeway,
+	}, nil
+}
+
+// VerifyJWT verifies the claims and signature of the token against the public keys
+func (k *keySetVerifier) VerifyJWT(token jose.JWT) error {
+	if err := verifyClaims(token, k.issuer, k.clientID, k.leeway); err != nil {
+		return err
+	}
+	verified, err := oidc.VerifySignature(token, k.getKeys())
+	if err != nil {
+		return fmt.Errorf("oidc: JWT signature verification failed: %v", err)
+	}
+	if !verified {
+		return errors.New("oidc: unable to verify JWT signature: no matching keys")
+	}
+
+	return nil
+}
+
+// getKeys returns the current public keys
+func (k *keySetVerifier) getKeys() []key.PublicKey {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.keys
+}
+
+// storeKeys provides entrypoint to update the public keys
+func (k *keySetVerifier) storeKeys(keys []key.PublicKey) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.keys = keys
+}
+
+// watch is responsible for adding a file notification and watch on the key files for changes
+func (k *keySetVerifier) watch() error {
+	log.Infof("adding a file watch on the public keys, files: %s", k.files)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, x := range k.files {
+		if err := watcher.Add(path.Dir(x)); err != nil {
+			return fmt.Errorf("unable to add watch on directory: %s, error: %s", path.Dir(x), err)
+		}
+	}
+
+	go func() {
+		log.Info("starting to watch changes to the public key files")
+		for {
+			select {
+			case event := <-watcher.Events:
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 || !containedIn(event.Name, k.files) {
+					continue
+				}
+				// step: reload the keys, we keep the current keys on failure
+				keys, err := loadPublicKeyFiles(k.files)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"filename": event.Name,
+						"error":    err.Error(),
+					}).Error("unable to load the updated public keys")
+					continue
+				}
+				k.storeKeys(keys)
+
+				log.Infof("replacing the public keys with updated version, keys: %d", len(keys))
+			case err := <-watcher.Errors:
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("recieved an error from the file watcher")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// loadPublicKeyFiles reads the public keys from a list of JWKS or PEM files
+func loadPublicKeyFiles(files []string) ([]key.PublicKey, error) {
+	var keys []key.PublicKey
+	for _, filename := range files {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		// step: a JWKS is json, anything else we assume is pem encoded
+		var jwks []jose.JWK
+		switch bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		case true:
+			jwks, err = decodeJWKS(content)
+		default:
+			jwks, err = decodePEMPublicKeys(content, filepath.Base(filename))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the public keys in %s, error: %s", filename, err)
+		}
+		for _, jwk := range jwks {
+			keys = append(keys, *key.NewPublicKey(jwk))
+		}
+	}
+	if len(keys) <= 0 {
+		return nil, errors.New("no public keys found in the key files")
+	}
+
+	return keys, nil
+}
+
+// decodeJWKS decodes the RSA signing keys from a JWKS document
+func decodeJWKS(content []byte) ([]jose.JWK, error) {
+	var set jose.JWKSet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	var list []jose.JWK
+	for _, jwk := range set.Keys {
+		if jwk.Type != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		list = append(list, jwk)
+	}
+
+	return list, nil
+}
+
+// decodePEMPublicKeys decodes the RSA public keys and certificates from pem encoded content
+func decodePEMPublicKeys(content []byte, name string) ([]jose.JWK, error) {
+	var list []jose.JWK
+	for {
+		var block *pem.Block
+		if block, content = pem.Decode(content); block == nil {
+			break
+		}
+		var pub interface{}
+		var err error
+		switch block.Type {
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				pub = cert.PublicKey
+			}
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = parsePKCS1PublicKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("only rsa public keys are supported")
+		}
+		list = append(list, jose.JWK{
+			ID:       fmt.Sprintf("%s-%d", name, len(list)),
+			Type:     "RSA",
+			Alg:      "RS256",
+			Use:      "sig",
+			Exponent: rsaKey.E,
+			Modulus:  rsaKey.N,
+		})
+	}
+
+	return list, nil
+}
+
+// parsePKCS1PublicKey parses a pkcs1 encoded rsa public key, x509.ParsePKCS1PublicKey is not
+// available in the go version we build with
+func parsePKCS1PublicKey(der []byte) (*rsa.PublicKey, error) {
+	key := new(rsa.PublicKey)
+	rest, err := asn1.Unmarshal(der, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after the rsa public key")
+	}
+	if key.N == nil || key.N.Sign() <= 0 || key.E <= 0 {
+		return nil, errors.New("invalid rsa public key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKeyFiles writes the provider public key into a JWKS and PEM file
+func newTestKeyFiles(t *testing.T, idp *fakeOAuthServer) (string, string, string) {
+	dir, err := ioutil.TempDir("", "keys")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	jwks, err := json.Marshal(map[string][]*jose.JWK{"keys": {&idp.key}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	der, err := x509.MarshalPKIXPublicKey(&idp.privateKey.PublicKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	jwksFile := filepath.Join(dir, "keys.json")
+	pemFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(jwksFile, jwks, 0600))
+	assert.NoError(t, ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	return dir, jwksFile, pemFile
+}
+
+func TestLoadPublicKeyFiles(t *testing.T) {
+	idp := newFakeOAuthServer()
+	dir, jwksFile, pemFile := newTestKeyFiles(t, idp)
+	defer os.RemoveAll(dir)
+
+	cs := []struct {
+		Files []string
+		Keys  int
+		Ok    bool
+	}{
+		{Files: []string{jwksFile}, Keys: 1, Ok: true},
+		{Files: []string{pemFile}, Keys: 1, Ok: true},
+		{Files: []string{jwksFile, pemFile}, Keys: 2, Ok: true},
+		{Files: []string{testCertificateFile}, Keys: 1, Ok: true},
+		{Files: []string{testPrivateKeyFile}},
+		{Files: []string{"./tests/does_not_exist"}},
+	}
+	for i, c := range cs {
+		keys, err := loadPublicKeyFiles(c.Files)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+		assert.Len(t, keys, c.Keys, "case %d, expected keys: %d", i, c.Keys)
+	}
+}
+
+func TestDecodePKCS1PublicKeys(t *testing.T) {
+	idp := newFakeOAuthServer()
+	der, err := asn1.Marshal(idp.privateKey.PublicKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Bytes []byte
+		Ok    bool
+	}{
+		{Bytes: der, Ok: true},
+		{Bytes: append(append([]byte{}, der...), 0x00)},
+		{Bytes: []byte("not a key")},
+	}
+	for i, c := range cs {
+		keys, err := decodePEMPublicKeys(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: c.Bytes}), "test")
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) || !assert.Len(t, keys, 1, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, idp.privateKey.PublicKey.E, keys[0].Exponent, "case %d, the exponent", i)
+		assert.Equal(t, 0, idp.privateKey.PublicKey.N.Cmp(keys[0].Modulus), "case %d, the modulus", i)
+	}
+}
+
+func TestKeySetVerifier(t *testing.T) {
+	idp := newFakeOAuthServer()
+	dir, jwksFile, pemFile := newTestKeyFiles(t, idp)
+	defer os.RemoveAll(dir)
+
+	signed, err := idp.signToken(idp.claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Files  []string
+		Issuer string
+		Ok     bool
+	}{
+		{Files: []string{jwksFile}, Issuer: idp.getLocation(), Ok: true},
+		{Files: []string{pemFile}, Issuer: idp.getLocation(), Ok: true},
+		{Files: []string{jwksFile}, Issuer: "https://another.example.com"},
+		{Files: []string{testCertificateFile}, Issuer: idp.getLocation()},
+	}
+	for i, c := range cs {
+		verifier, err := newKeySetVerifier(c.Files, c.Issuer, "test", 0)
+		if !assert.NoError(t, err, "case %d, unable to create verifier", i) {
+			continue
+		}
+		err = verifyToken(verifier, *signed)
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have failed", i)
+		} else {
+			assert.Error(t, err, "case %d should have failed", i)
+		}
+	}
+}
+
+func TestKeySetVerifierWatch(t *testing.T) {
+	idp := newFakeOAuthServer()
+	dir, jwksFile, _ := newTestKeyFiles(t, idp)
+	defer os.RemoveAll(dir)
+
+	// step: start with a key which cannot verify the tokens
+	content, err := ioutil.ReadFile(testCertificateFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	keyFile := filepath.Join(dir, "watched.pem")
+	assert.NoError(t, ioutil.WriteFile(keyFile, content, 0600))
+	verifier, err := newKeySetVerifier([]string{keyFile}, idp.getLocation(), "test", 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, verifier.watch())
+	signed, _ := idp.signToken(idp.claims)
+	assert.Error(t, verifyToken(verifier, *signed))
+
+	// step: rotate the keys and wait for the reload
+	content, _ = ioutil.ReadFile(jwksFile)
+	assert.NoError(t, ioutil.WriteFile(keyFile, content, 0600))
+	for i := 0; i < 50; i++ {
+		if err = verifyToken(verifier, *signed); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+}
+
+func TestOfflineVerificationProxy(t *testing.T) {
+	idp := newFakeOAuthServer()
+	dir, jwksFile, _ := newTestKeyFiles(t, idp)
+	defer os.RemoveAll(dir)
+
+	config := newFakeKeycloakConfig()
+	config.ClientID = "test"
+	config.DiscoveryURL = ""
+	config.PublicKeyFiles = []string{jwksFile}
+	config.TokenIssuer = idp.getLocation()
+	config.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}}}
+	proxy, err := newProxy(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy.upstream = new(testReverseProxy)
+	svc := httptest.NewServer(proxy.router)
+
+	signed, _ := idp.signToken(idp.claims)
+	cs := []struct {
+		URL      string
+		Token    string
+		Expected int
+	}{
+		{URL: "/admin", Token: signed.Encode(), Expected: http.StatusOK},
+		{URL: "/admin", Token: "bad.token.here", Expected: http.StatusUnauthorized},
+		{URL: "/admin", Expected: http.StatusUnauthorized},
+		{URL: oauthURL + authorizationURL, Expected: http.StatusNotImplemented},
+		{URL: oauthURL + callbackURL + "?code=test", Expected: http.StatusNotImplemented},
+	}
+	for i, c := range cs {
+		client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+		if c.Token != "" {
+			client.SetAuthToken(c.Token)
+		}
+		resp, err := client.R().Get(svc.URL + c.URL)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, resp.StatusCode(), "case %d, expected: %d", i, c.Expected)
+	}
+}